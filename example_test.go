@@ -99,6 +99,19 @@ func Example_mappings() {
 	// output: map[john:123 mary:456]
 }
 
+// This example demonstrates a map whose entries are separated by commas
+func Example_mappingWithSep() {
+	// The args you would pass in on the command line
+	os.Args = split("./example --values one=two,three=four")
+
+	var args struct {
+		Values map[string]string `sep:","`
+	}
+	MustParse(&args)
+	fmt.Println(args.Values)
+	// output: map[one:two three:four]
+}
+
 type commaSeparated struct {
 	M map[string]string
 }
@@ -201,13 +214,12 @@ func Example_helpPlaceholder() {
 	MustParse(&args)
 
 	// output:
-
 	// Usage: example [--optimize LEVEL] [--maxjobs N] SRC [DST [DST ...]]
-
+	//
 	// Positional arguments:
 	//   SRC
 	//   DST
-
+	//
 	// Options:
 	//   --optimize LEVEL, -O LEVEL
 	//                          optimization level
@@ -0,0 +1,13 @@
+//go:build go1.18
+// +build go1.18
+
+package arg
+
+// MustParseInto allocates a new T, processes command line arguments into it
+// in the same way as MustParse, and returns a pointer to it. T must be a
+// struct type.
+func MustParseInto[T any]() *T {
+	dest := new(T)
+	MustParse(dest)
+	return dest
+}
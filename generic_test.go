@@ -0,0 +1,30 @@
+//go:build go1.18
+// +build go1.18
+
+package arg
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMustParseInto(t *testing.T) {
+	originalArgs := os.Args
+	defer func() {
+		os.Args = originalArgs
+	}()
+
+	type args struct {
+		Foo   string
+		Count int `arg:"positional"`
+	}
+
+	os.Args = []string{"example", "--foo", "bar", "3"}
+	parsed := MustParseInto[args]()
+	require.NotNil(t, parsed)
+	assert.Equal(t, "bar", parsed.Foo)
+	assert.Equal(t, 3, parsed.Count)
+}
@@ -3,6 +3,7 @@ module github.com/alexflint/go-arg
 require (
 	github.com/alexflint/go-scalar v1.1.0
 	github.com/stretchr/testify v1.2.2
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
 
 go 1.13
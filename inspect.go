@@ -0,0 +1,365 @@
+package arg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// redacted is displayed in place of the values of sensitive options
+const redacted = "***"
+
+// Sources of option values, as returned by Parser.Source
+const (
+	SourceCommandLine = "cli"
+	SourceEnv         = "env"
+	SourceDefault     = "default"
+	SourcePrompt      = "prompt"
+	SourceUnset       = "unset"
+)
+
+// OptionInfo describes an option or positional argument, as passed to
+// Config.OnSpec
+type OptionInfo struct {
+	Long        string // the long name, without dashes, or empty if none
+	Short       string // the short name, without a dash, or empty if none
+	Env         string // the environment variable, or empty if none
+	Help        string
+	Default     string
+	Placeholder string
+	Required    bool
+	Positional  bool
+	Multiple    bool // true for slices and maps
+}
+
+// info returns the public description of the option
+func (s *spec) info() OptionInfo {
+	return OptionInfo{
+		Long:        s.long,
+		Short:       s.short,
+		Env:         s.env,
+		Help:        s.help,
+		Default:     s.defaultVal,
+		Placeholder: s.placeholder,
+		Required:    s.required,
+		Positional:  s.positional,
+		Multiple:    s.cardinality == multiple,
+	}
+}
+
+// fieldPath returns the dotted sequence of field names by which the option
+// is reached from its destination struct, such as "Get.ID"
+func (s *spec) fieldPath() string {
+	var names []string
+	for _, field := range s.dest.fields {
+		names = append(names, field.Name)
+	}
+	return strings.Join(names, ".")
+}
+
+// visitSpecs calls Config.OnSpec for each option of cmd and its subcommands
+func (p *Parser) visitSpecs(cmd *command) {
+	for _, spec := range cmd.specs {
+		p.config.OnSpec(spec.fieldPath(), spec.info())
+	}
+	for _, subcmd := range cmd.subcommands {
+		p.visitSpecs(subcmd)
+	}
+}
+
+// Source returns where the value of an option came from in the most recent
+// call to Parse: SourceCommandLine, SourceEnv, SourceDefault, SourcePrompt,
+// or SourceUnset if the option was not set or there is no such option. The
+// option is identified by its field name or its long name.
+func (p *Parser) Source(name string) string {
+	spec := findSibling(p.activeSpecs(), name)
+	if spec == nil || p.sources[spec] == "" {
+		return SourceUnset
+	}
+	return p.sources[spec]
+}
+
+// Describe returns a single-line summary of the options that have non-zero
+// values, as space-separated name=value pairs, for the top-level command and
+// any subcommands that were selected. The values of options tagged
+// "sensitive" are shown as "***". This is intended for audit logs.
+func (p *Parser) Describe() string {
+	var parts []string
+	for _, spec := range p.activeSpecs() {
+		v := p.val(spec.dest)
+		if !v.IsValid() || isZero(v) {
+			continue
+		}
+
+		name := spec.long
+		if name == "" || spec.positional {
+			name = strings.ToLower(spec.field.Name)
+		}
+
+		value := redacted
+		if !spec.sensitive {
+			value = formatValue(v)
+			if strings.ContainsAny(value, " \t\n\"") {
+				value = strconv.Quote(value)
+			}
+		}
+		parts = append(parts, name+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// WriteEnvHelp writes the environment variables read by the program, for the
+// top-level command and any subcommands that were selected, along with the
+// current value of each option and where that value came from. The values of
+// options tagged "sensitive" are shown as "***".
+func (p *Parser) WriteEnvHelp(w io.Writer) {
+	fmt.Fprintln(w, "Environment variables:")
+	for _, spec := range p.activeSpecs() {
+		env := p.envVar(spec)
+		if env == "" {
+			continue
+		}
+
+		var value string
+		if v := p.val(spec.dest); v.IsValid() && !isZero(v) {
+			value = redacted
+			if !spec.sensitive {
+				value = formatValue(v)
+			}
+		}
+
+		var source string
+		switch p.sources[spec] {
+		case SourceCommandLine:
+			source = "from the command line"
+		case SourceEnv:
+			source = "from the environment"
+		case SourceDefault:
+			source = "from the default"
+		case SourcePrompt:
+			source = "from the terminal"
+		default:
+			source = "unset"
+		}
+		p.printTwoCols(w, env+"="+value, source, "", "")
+	}
+}
+
+// WriteEnv writes an "export NAME=value" line for each option that has an
+// environment variable and was set by the most recent call to Parse, for the
+// top-level command and any subcommands that were selected. Each value is
+// written in the form read from the environment and quoted for the shell, so
+// that the output can be sourced to repeat a run. The values of options
+// tagged "sensitive" are written as "***". If a value cannot be written so
+// that it reads back the same, such as a slice element that contains the
+// separator, then an error is returned and nothing is written.
+func (p *Parser) WriteEnv(w io.Writer) error {
+	var b strings.Builder
+	for _, spec := range p.activeSpecs() {
+		env := p.envVar(spec)
+		if env == "" || p.sources[spec] == "" {
+			continue
+		}
+		value := redacted
+		if !spec.sensitive {
+			var err error
+			value, err = p.envValue(spec)
+			if err != nil {
+				return fmt.Errorf("cannot write environment variable %s: %v", env, err)
+			}
+		}
+		fmt.Fprintf(&b, "export %s=%s\n", env, shellQuote(value))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// envValue returns the value of an option in the form in which it is read
+// from its environment variable
+func (p *Parser) envValue(spec *spec) (string, error) {
+	v := p.val(spec.dest)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	if spec.cardinality != multiple {
+		switch {
+		case spec.json:
+			b, _ := json.Marshal(v.Interface())
+			return string(b), nil
+		case spec.format != "":
+			return formatTime(v, spec.format), nil
+		case spec.base != 0 && v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+			return strconv.FormatInt(v.Int(), spec.base), nil
+		case spec.base != 0:
+			return strconv.FormatUint(v.Uint(), spec.base), nil
+		case spec.invert && v.Kind() == reflect.Bool:
+			return strconv.FormatBool(!v.Bool()), nil
+		}
+		return formatValue(v), nil
+	}
+
+	// collect the values of a slice, or the key=value pairs of a map in
+	// order of their keys
+	var values []string
+	if v.Kind() == reflect.Map {
+		for _, key := range v.MapKeys() {
+			k, elem := formatValue(key), v.MapIndex(key)
+			if elem.Kind() == reflect.Slice {
+				for i := 0; i < elem.Len(); i++ {
+					values = append(values, k+"="+formatValue(elem.Index(i)))
+				}
+			} else {
+				values = append(values, k+"="+formatValue(elem))
+			}
+		}
+		sort.Strings(values)
+	} else {
+		for i := 0; i < v.Len(); i++ {
+			if spec.format != "" {
+				values = append(values, formatTime(v.Index(i), spec.format))
+			} else {
+				values = append(values, formatValue(v.Index(i)))
+			}
+		}
+	}
+
+	switch {
+	case spec.envCSV:
+		var b strings.Builder
+		cw := csv.NewWriter(&b)
+		cw.Write(values)
+		cw.Flush()
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	case spec.envSep == "" || strings.TrimSpace(spec.envSep) == "":
+		for _, value := range values {
+			if value == "" || strings.IndexFunc(value, unicode.IsSpace) != -1 {
+				return "", fmt.Errorf("%q would not be read back as one value because it is empty or contains whitespace", value)
+			}
+		}
+		return strings.Join(values, " "), nil
+	}
+	for _, value := range values {
+		if strings.Contains(value, spec.envSep) {
+			return "", fmt.Errorf("%q would not be read back as one value because it contains the separator %q", value, spec.envSep)
+		}
+	}
+	return strings.Join(values, spec.envSep), nil
+}
+
+// shellQuote quotes s with single quotes, unless it consists only of
+// characters that the shell leaves alone
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.,:/=@+%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// activeSpecs returns the options for the top-level command followed by those
+// of each subcommand that was selected by the most recent call to Parse
+func (p *Parser) activeSpecs() []*spec {
+	if p.lastCmd == nil {
+		return specsInScope(p.cmd)
+	}
+	return specsInScope(p.lastCmd)
+}
+
+// specsInScope returns the options of the top-level command followed by those
+// of each command down to and including cmd
+func specsInScope(cmd *command) []*spec {
+	var cmds []*command
+	for ; cmd != nil; cmd = cmd.parent {
+		cmds = append(cmds, cmd)
+	}
+
+	var specs []*spec
+	for i := len(cmds) - 1; i >= 0; i-- {
+		specs = append(specs, cmds[i].specs...)
+	}
+	return specs
+}
+
+// redactedError is an error whose message has had sensitive values removed
+type redactedError struct {
+	msg    string
+	err    error
+	values []string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the wrapped error with the sensitive values removed from it
+// too, so that they cannot be recovered with errors.As
+func (e *redactedError) Unwrap() error {
+	return scrub(e.err, e.values)
+}
+
+// redact returns an error that does not reveal any of the given values, if
+// the option is sensitive. Quoted occurrences of the values are replaced with
+// "***", and if a value still appears anywhere in the message then the
+// message is replaced entirely.
+func redact(spec *spec, err error, values ...string) error {
+	if !spec.sensitive {
+		return err
+	}
+	return &redactedError{msg: redactMessage(err.Error(), values), err: err, values: values}
+}
+
+// redactMessage removes the given values from an error message
+func redactMessage(msg string, values []string) string {
+	for _, value := range values {
+		msg = strings.Replace(msg, strconv.Quote(value), strconv.Quote(redacted), -1)
+	}
+	for _, value := range values {
+		if value != "" && strings.Contains(msg, value) {
+			return "invalid value"
+		}
+	}
+	return msg
+}
+
+// scrub returns err, or a copy of it, that does not reveal any of the given
+// values. A *strconv.NumError keeps its type with "***" in place of the
+// number. Other errors that mention a value are replaced by a redactedError,
+// which scrubs the rest of the chain in turn.
+func scrub(err error, values []string) error {
+	if err == nil {
+		return nil
+	}
+	if numErr, ok := err.(*strconv.NumError); ok {
+		scrubbed := *numErr
+		scrubbed.Num = redacted
+		return &scrubbed
+	}
+	msg := err.Error()
+	for _, value := range values {
+		if value != "" && strings.Contains(msg, value) {
+			return &redactedError{msg: redactMessage(msg, values), err: errors.Unwrap(err), values: values}
+		}
+	}
+	return err
+}
+
+// displayDefault returns the default value of an option for display in help
+func (s *spec) displayDefault() string {
+	if s.sensitive && s.defaultVal != "" {
+		return redacted
+	}
+	if s.defaultVal == "" && s.defaultFrom != nil {
+		return "same as " + s.defaultFrom.name()
+	}
+	return s.defaultVal
+}
@@ -0,0 +1,279 @@
+package arg
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribe(t *testing.T) {
+	var args struct {
+		Host    string
+		Port    int `default:"8080"`
+		Verbose bool
+		Token   string `arg:"sensitive"`
+		Input   string `arg:"positional"`
+		Name    string
+	}
+	p, err := pparse("--host example.com --token s3cret --name a\tb in.txt", &args)
+	require.NoError(t, err)
+	assert.Equal(t, `host=example.com port=8080 token=*** input=in.txt name="a\tb"`, p.Describe())
+}
+
+func TestDescribeSubcommand(t *testing.T) {
+	var args struct {
+		Verbose bool
+		Get     *struct {
+			Item string `arg:"positional"`
+		} `arg:"subcommand"`
+	}
+	p, err := pparse("--verbose get x", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "verbose=true item=x", p.Describe())
+}
+
+func TestSensitiveErrorRedacted(t *testing.T) {
+	var args struct {
+		Pin int `arg:"sensitive"`
+	}
+	err := parse("--pin=12ab", &args)
+	assert.EqualError(t, err, `error processing --pin=***: strconv.ParseInt: parsing "***": invalid syntax`)
+
+	err = parse("--pin 12ab", &args)
+	assert.EqualError(t, err, `error processing --pin: strconv.ParseInt: parsing "***": invalid syntax`)
+}
+
+func TestSensitiveErrorUnwrap(t *testing.T) {
+	var args struct {
+		Pin int `arg:"sensitive"`
+	}
+	err := parse("--pin 12ab34", &args)
+	require.Error(t, err)
+
+	var numErr *strconv.NumError
+	require.True(t, errors.As(err, &numErr))
+	assert.Equal(t, "***", numErr.Num)
+	assert.Equal(t, strconv.ErrSyntax, numErr.Err)
+	assert.True(t, errors.Is(err, strconv.ErrSyntax))
+
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		assert.NotContains(t, e.Error(), "12ab34")
+	}
+}
+
+func TestSensitiveErrorFallback(t *testing.T) {
+	var args struct {
+		Pin int `arg:"sensitive"`
+	}
+	// "x" appears in the word "syntax" so the whole message is replaced
+	err := parse("--pin x", &args)
+	assert.EqualError(t, err, `error processing --pin: invalid value`)
+}
+
+func TestSensitiveEnvironmentErrorRedacted(t *testing.T) {
+	var args struct {
+		Pin int `arg:"env,sensitive"`
+	}
+	_, err := parseWithEnv("", []string{"PIN=12ab"}, &args)
+	assert.EqualError(t, err, `error processing environment variable PIN: strconv.ParseInt: parsing "***": invalid syntax`)
+}
+
+func TestSensitiveDefaultRedactedInHelp(t *testing.T) {
+	var args struct {
+		Token string `arg:"sensitive" default:"s3cret" help:"api token"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "--token TOKEN          api token [default: ***]\n")
+	assert.NotContains(t, help.String(), "s3cret")
+}
+
+func TestSource(t *testing.T) {
+	var args struct {
+		Host    string `arg:"--host"`
+		Port    int    `arg:"env:SOURCE_TEST_PORT"`
+		Retries int    `default:"3"`
+		Debug   bool
+		Input   string `arg:"positional"`
+	}
+	p, err := parseWithEnv("--host example.com in.txt", []string{"SOURCE_TEST_PORT=8080"}, &args)
+	os.Unsetenv("SOURCE_TEST_PORT")
+	require.NoError(t, err)
+
+	assert.Equal(t, SourceCommandLine, p.Source("host"))
+	assert.Equal(t, SourceCommandLine, p.Source("--host"))
+	assert.Equal(t, SourceEnv, p.Source("Port"))
+	assert.Equal(t, SourceDefault, p.Source("retries"))
+	assert.Equal(t, SourceUnset, p.Source("Debug"))
+	assert.Equal(t, SourceCommandLine, p.Source("Input"))
+	assert.Equal(t, SourceUnset, p.Source("nope"))
+}
+
+func TestSourceCommandLineOverridesEnv(t *testing.T) {
+	var args struct {
+		Port int `arg:"env:SOURCE_TEST_PORT"`
+	}
+	p, err := parseWithEnv("--port 1", []string{"SOURCE_TEST_PORT=2"}, &args)
+	os.Unsetenv("SOURCE_TEST_PORT")
+	require.NoError(t, err)
+	assert.Equal(t, 1, args.Port)
+	assert.Equal(t, SourceCommandLine, p.Source("port"))
+}
+
+func TestOnSpec(t *testing.T) {
+	type Common struct {
+		Verbose bool `arg:"-v"`
+	}
+	var args struct {
+		Common
+		Host string `arg:"required" help:"server host"`
+		Get  *struct {
+			ID   int `arg:"positional"`
+			Tags []string
+		} `arg:"subcommand"`
+	}
+
+	infos := make(map[string]OptionInfo)
+	var paths []string
+	_, err := NewParser(Config{OnSpec: func(fieldPath string, info OptionInfo) {
+		paths = append(paths, fieldPath)
+		infos[fieldPath] = info
+	}}, &args)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"Verbose", "Host", "Get.ID", "Get.Tags"}, paths)
+	assert.Equal(t, OptionInfo{Long: "verbose", Short: "v", Placeholder: "VERBOSE"}, infos["Verbose"])
+	assert.Equal(t, OptionInfo{Long: "host", Help: "server host", Placeholder: "HOST", Required: true}, infos["Host"])
+	assert.True(t, infos["Get.ID"].Positional)
+	assert.True(t, infos["Get.Tags"].Multiple)
+}
+
+func TestEnvHelp(t *testing.T) {
+	var args struct {
+		Host    string `arg:"env" default:"localhost"`
+		Port    int    `arg:"env"`
+		Token   string `arg:"env,sensitive"`
+		Timeout int    `arg:"env"`
+		Verbose bool
+	}
+	setenv(t, "PORT", "8080")
+	setenv(t, "TOKEN", "secret")
+	defer os.Unsetenv("PORT")
+	defer os.Unsetenv("TOKEN")
+
+	var out bytes.Buffer
+	var exitCode *int
+	p, err := NewParser(Config{
+		EnvHelpFlag: "--help-env",
+		Output:      &out,
+		Exit:        func(code int) { exitCode = &code },
+	}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--help-env", "--token", "abc"})
+	assert.Equal(t, ErrEnvHelp, err)
+
+	p.MustParse([]string{"--help-env", "--token", "abc"})
+	require.NotNil(t, exitCode)
+	assert.Equal(t, 0, *exitCode)
+	assert.Equal(t, `Environment variables:
+  HOST=localhost         from the default
+  PORT=8080              from the environment
+  TOKEN=***              from the command line
+  TIMEOUT=               unset
+`, out.String())
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.NotContains(t, help.String(), "help-env")
+}
+
+func TestWriteEnv(t *testing.T) {
+	var args struct {
+		Host    string            `arg:"env" default:"localhost"`
+		Port    int               `arg:"env"`
+		Name    string            `arg:"env"`
+		Token   string            `arg:"env,sensitive"`
+		Tags    []string          `arg:"env"`
+		Labels  map[string]string `arg:"env" envsep:";"`
+		Quiet   bool              `arg:"--verbose,env:VERBOSE,invert"`
+		Timeout int               `arg:"env"`
+		Debug   bool
+	}
+	setenv(t, "PORT", "8080")
+	defer os.Unsetenv("PORT")
+
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{
+		"--name", "it's me", "--token", "secret", "--tags", "a", "b,c",
+		"--labels", "z=1", "a=2", "--verbose", "--debug",
+	})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, p.WriteEnv(&out))
+	assert.Equal(t, `export HOST=localhost
+export PORT=8080
+export NAME='it'\''s me'
+export TOKEN='***'
+export TAGS='a b,c'
+export LABELS='a=2;z=1'
+export VERBOSE=true
+`, out.String())
+}
+
+func TestWriteEnvRoundTrip(t *testing.T) {
+	type argsType struct {
+		Words []string `arg:"env"`
+		Paths []string `arg:"env" envsep:":"`
+		Tags  []string `arg:"env" envcsv:""`
+	}
+	var args argsType
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"--words", "x", "y", "--paths", "/a b", "/c", "--tags", "a b", "c, d", `"e"`})
+	require.NoError(t, err)
+
+	var env []string
+	for _, spec := range p.cmd.specs {
+		value, err := p.envValue(spec)
+		require.NoError(t, err)
+		env = append(env, spec.env+"="+value)
+	}
+
+	var again argsType
+	_, err = parseWithEnv("", env, &again)
+	require.NoError(t, err)
+	assert.Equal(t, args, again)
+}
+
+func TestWriteEnvSeparatorInValue(t *testing.T) {
+	var args struct {
+		Host  string   `arg:"env"`
+		Tags  []string `arg:"env"`
+		Paths []string `arg:"env" envsep:":"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--host", "example.com", "--tags", "a b"})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	err = p.WriteEnv(&out)
+	assert.EqualError(t, err, `cannot write environment variable TAGS: "a b" would not be read back as one value because it is empty or contains whitespace`)
+	assert.Equal(t, "", out.String())
+
+	err = p.Parse([]string{"--paths", "/a:/b"})
+	require.NoError(t, err)
+	err = p.WriteEnv(&out)
+	assert.EqualError(t, err, `cannot write environment variable PATHS: "/a:/b" would not be read back as one value because it contains the separator ":"`)
+}
@@ -3,12 +3,18 @@ package arg
 import (
 	"encoding"
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	scalar "github.com/alexflint/go-scalar"
 )
@@ -46,55 +52,141 @@ type spec struct {
 	dest        path
 	field       reflect.StructField // the struct field from which this option was created
 	long        string              // the --long form for this option, or empty if none
+	aliases     []string            // additional --long forms for this option
 	short       string              // the -s short form for this option, or empty if none
 	cardinality cardinality         // determines how many tokens will be present (possible values: zero, one, multiple)
 	required    bool                // if true, this option must be present on the command line
 	positional  bool                // if true, this option will be looked for in the positional flags
+	passthrough bool                // if true, this option receives all arguments after "--" verbatim
+	unknown     bool                // if true, this map receives any unrecognized "--key value" options
 	separate    bool                // if true, each slice and map entry will have its own --flag
 	help        string              // the help text for this option
 	env         string              // the name of the environment variable for this option, or empty for none
 	defaultVal  string              // default value for this option
+	defaultVals []string            // for a slice, the default values from the tag, split on whitespace or sep
+	defaultRef  string              // if non-empty, the field whose value is the default, as in default:"$Host"
+	defaultFrom *spec               // the option named by defaultRef, resolved once all fields are known
 	placeholder string              // name of the data in help
+	sep         string              // if non-empty, each value token is split on this separator
+	envSep      string              // if non-empty, environment values are split on this rather than on whitespace
+	envCSV      bool                // if true, environment values are parsed as CSV rather than split
+	requiredIf  *condition          // if non-nil, this option is required when the condition holds
+	group       string              // name of the group of mutually exclusive options, or empty for none
+	groupReq    bool                // if true, exactly one option from the group must be present
+	sensitive   bool                // if true, the value of this option is redacted wherever it is displayed
+	choices     []string            // if non-empty, the values that this option may take
+	foldChoices bool                // if true, choices are matched case-insensitively
+	base        int                 // if non-zero, the base in which integers are parsed
+	stdin       bool                // if true, the value "-" means read the value from standard input
+	prompt      bool                // if true, a missing value is read from the terminal when Config.AllowPrompt is set
+	json        bool                // if true, the value is a JSON document decoded into the field
+	dotted      bool                // if true, a struct field is set from path=value pairs naming its fields
+	invert      bool                // if true, the boolean given by the user is negated before it is stored
+	unique      bool                // if true, a slice may not contain the same value twice
+	min, max    int                 // if non-zero, bounds on the number of values in a slice
+	format      string              // if non-empty, the form of a time value: "unix", "unixmilli", or a layout
+	transforms  []string            // changes applied to each value before it is parsed: "lower", "upper", or "trim"
+	until       string              // if non-empty, a slice collects every value up to this sentinel
+	pathExists  bool                // if true, the value must name an existing file or directory
+	pathDir     bool                // if true, the value must name an existing directory
+	pattern     *regexp.Regexp      // if non-nil, each string value must match this
+	explicit    bool                // if true, a boolean flag must be given a value, as in --foo=true
+}
+
+// name returns the name by which this option is referred to in error messages.
+// Positionals are referred to by their placeholder, as in the usage text.
+func (s *spec) name() string {
+	switch {
+	case s.positional && s.placeholder != "":
+		return s.placeholder
+	case s.long != "" && !s.positional:
+		return "--" + s.long
+	}
+	return strings.ToLower(s.field.Name)
 }
 
 // command represents a named subcommand, or the top-level command
 type command struct {
-	name        string
-	help        string
-	dest        path
-	specs       []*spec
-	subcommands []*command
-	parent      *command
+	name              string
+	help              string
+	dest              path
+	specs             []*spec
+	subcommands       []*command
+	defaultSubcommand *command // the subcommand to use when none is named, or nil
+	parent            *command
+}
+
+// numPositionals returns the number of positional fields in this command
+func (c *command) numPositionals() int {
+	var n int
+	for _, spec := range c.specs {
+		if spec.positional {
+			n++
+		}
+	}
+	return n
 }
 
 // ErrHelp indicates that -h or --help were provided
 var ErrHelp = errors.New("help requested by user")
 
-// ErrVersion indicates that --version was provided
+// ErrEnvHelp indicates that Config.EnvHelpFlag was provided
+var ErrEnvHelp = errors.New("environment help requested by user")
+
+// ErrVersion indicates that --version was provided. It is only returned when
+// the program has a version, from the Versioned interface; otherwise
+// "--version" is processed like any other argument.
 var ErrVersion = errors.New("version requested by user")
 
 // MustParse processes command line arguments and exits upon failure
 func MustParse(dest ...interface{}) *Parser {
 	p, err := NewParser(Config{}, dest...)
 	if err != nil {
-		fmt.Fprintln(stdout, err)
+		fmt.Fprintln(stderr, "error:", err)
 		osExit(-1)
 		return nil // just in case osExit was monkey-patched
 	}
 
-	err = p.Parse(flags())
+	p.ParseAndExit()
+	return p
+}
+
+// MustParse processes the given command line arguments and exits upon
+// failure, in the same way as the package-level MustParse. Help, version, and
+// error output go to Config.Out and Config.Err, and Config.Exit is used to
+// exit.
+func (p *Parser) MustParse(args []string) {
+	err := p.Parse(args)
+	var runErr *RunError
 	switch {
 	case err == ErrHelp:
-		p.writeHelpForSubcommand(stdout, p.lastCmd)
-		osExit(0)
+		p.writeHelpForSubcommand(p.out(), p.lastCmd)
+		p.exit(0)
 	case err == ErrVersion:
-		fmt.Fprintln(stdout, p.version)
-		osExit(0)
+		fmt.Fprintln(p.out(), p.version)
+		p.exit(0)
+	case err == ErrEnvHelp:
+		p.WriteEnvHelp(p.out())
+		p.exit(0)
+	case errors.As(err, &runErr):
+		// the command line was fine, so there is no need to show the usage
+		fmt.Fprintln(p.err(), "error:", runErr)
+		p.exit(-1)
 	case err != nil:
 		p.failWithSubcommand(err.Error(), p.lastCmd)
 	}
+}
 
-	return p
+// ParseAndExit processes Config.Args or, if that is nil, the command line of
+// the current process, in the same way as MustParse. On a help or version
+// request it writes the output and exits with status zero, and on an error it
+// writes the usage and the error and exits with a non-zero status.
+func (p *Parser) ParseAndExit() {
+	args := p.config.Args
+	if args == nil {
+		args = flags()
+	}
+	p.MustParse(args)
 }
 
 // Parse processes command line arguments and stores them in dest
@@ -121,6 +213,171 @@ type Config struct {
 
 	// IgnoreEnv instructs the library not to read environment variables
 	IgnoreEnv bool
+
+	// AllowExtraPositionals instructs the library to keep positional arguments
+	// that do not correspond to any field, rather than failing. They can be
+	// retrieved after parsing with ExtraPositionals.
+	AllowExtraPositionals bool
+
+	// SectionOrder overrides the order of the sections in the help text. It
+	// should contain some of SectionPositionals, SectionOptions,
+	// SectionGlobals, SectionCommands, and SectionEnvironment. Unknown names
+	// are ignored and sections not listed are written afterwards in the
+	// default order.
+	SectionOrder []string
+
+	// Out is where help and version information is written by MustParse. It
+	// defaults to os.Stdout.
+	Out io.Writer
+
+	// Err is where usage errors are written by MustParse and Fail. It
+	// defaults to os.Stderr.
+	Err io.Writer
+
+	// Output, if set, is where both help and errors are written, taking
+	// precedence over Out and Err.
+	Output io.Writer
+
+	// Exit is called to terminate the program after help, version, or usage
+	// errors have been written. It defaults to os.Exit.
+	Exit func(int)
+
+	// HelpFlags are the arguments that request help, such as "--usage" or
+	// "-?". If nil, "-h" and "--help" are used. If empty but not nil, help
+	// cannot be requested from the command line. A help flag that is also
+	// declared as an option of the top-level command is left to that option.
+	HelpFlags []string
+
+	// DeferValidation instructs Parse not to check required options,
+	// mutually exclusive groups, and other constraints. The program should
+	// call Parser.Validate itself once it is ready.
+	DeferValidation bool
+
+	// HideGlobalOptions omits the options inherited from parent commands
+	// when writing help for a subcommand.
+	HideGlobalOptions bool
+
+	// AllowAbbrevSubcommands lets the user type any unambiguous prefix of
+	// a subcommand name, such as "com" for "commit". An exact match always
+	// wins over a prefix match.
+	AllowAbbrevSubcommands bool
+
+	// StrictDashes requires long option names to be preceded by "--" and
+	// short names by "-", so that "-verbose" is rejected as unknown rather
+	// than treated as "--verbose".
+	StrictDashes bool
+
+	// PreProcess, if non-nil, is called with the command line arguments
+	// before they are parsed, for example to expand user-defined aliases.
+	// The slice it returns is parsed in their place.
+	PreProcess func([]string) []string
+
+	// Args, if non-nil, are the command line arguments parsed when Parse,
+	// MustParse, or ParseStream is called with a nil slice. This allows the
+	// arguments to be configured once, for example in tests.
+	Args []string
+
+	// In is where fields marked with "stdin" read their value from when
+	// given "-". It defaults to os.Stdin.
+	In io.Reader
+
+	// MaxPositionals, if positive, is the largest number of positional
+	// arguments that may be given, guarding against an accidentally expanded
+	// glob. Zero means no limit.
+	MaxPositionals int
+
+	// LongValueSeparators are the strings that may separate a long option
+	// from an attached value, as in "--foo=bar" or "--foo:bar". The earliest
+	// separator in the argument is used. If nil, only "=" is accepted.
+	LongValueSeparators []string
+
+	// ShowCommandTree lists nested subcommands, indented under their
+	// parents, in the Commands section of the help text rather than only
+	// the immediate subcommands.
+	ShowCommandTree bool
+
+	// DecimalSeparator, if set, is accepted in place of "." in the values
+	// of floating point options, so that "3,14" can be parsed with ','.
+	DecimalSeparator rune
+
+	// ExpandEnv replaces references to environment variables such as
+	// "${HOME}" in command line arguments before they are parsed, using
+	// os.ExpandEnv. Unset variables expand to the empty string. Arguments
+	// after "--" are not expanded.
+	ExpandEnv bool
+
+	// OnSpec, if non-nil, is called by NewParser for each option and
+	// positional argument, including those of subcommands, with the dotted
+	// path of its field and a description of it. This allows frameworks to
+	// register or check options without access to the parser's internals.
+	OnSpec func(fieldPath string, info OptionInfo)
+
+	// ShowEnvSection adds a section to the help text listing the environment
+	// variables that are read, including those of options that have no
+	// command line form and so appear nowhere else in the help.
+	ShowEnvSection bool
+
+	// HelpColumn is the column at which help text starts in the list of
+	// options. The help for an option whose names and placeholders reach
+	// this column starts on the following line instead. Defaults to 25.
+	HelpColumn int
+
+	// HelpWidth, if positive, is the width to which the help text of each
+	// option, positional, and subcommand is wrapped. The width does not
+	// depend on the terminal, so the help text is the same wherever it is
+	// written. By default the help text is not wrapped.
+	HelpWidth int
+
+	// SliceStopAtKnownFlag changes how the values of a slice option are
+	// collected, as in "--files a.txt -b.txt". Normally collection stops at
+	// any argument beginning with a dash, but with this set it stops only at
+	// the options of the commands selected so far, so that other arguments
+	// beginning with a dash are taken as values.
+	SliceStopAtKnownFlag bool
+
+	// AutoRun instructs Parse to call Run on the selected subcommand, if it
+	// implements Runner, after a successful parse. An error from Run is
+	// returned by Parse as a *RunError. AutoRun cannot be combined with
+	// DeferValidation, since the subcommand would run before Validate.
+	AutoRun bool
+
+	// ArgsEnv is the name of an environment variable from which Parse,
+	// MustParse, and ParseAndExit read the arguments, split as a shell
+	// would, when they are given no arguments
+	ArgsEnv string
+
+	// NoEnvForRequired prevents required options from being read from the
+	// environment, so that they must always be given on the command line
+	NoEnvForRequired bool
+
+	// DisableClustering turns off the splitting of a single-dash argument
+	// into a short option and its value, as in "-eEXPR", so that each such
+	// argument must name an option in full. This suits programs with
+	// single-dash long options such as "-verbose".
+	DisableClustering bool
+
+	// AllowPrompt lets Parse ask for the value of each option marked with
+	// "prompt" that was given neither on the command line nor in the
+	// environment. The value is read from the terminal without echoing it.
+	// If Config.In is not a terminal then Parse fails instead.
+	AllowPrompt bool
+
+	// EnvHelpFlag, if non-empty, is an argument such as "--help-env" that
+	// makes Parse return ErrEnvHelp once the other arguments have been
+	// processed, and makes MustParse write the environment variables read by
+	// the program along with the values of their options. It is not listed
+	// in the help text.
+	EnvHelpFlag string
+
+	// PositionalsHeading, OptionsHeading, GlobalsHeading, CommandsHeading,
+	// and EnvironmentHeading replace the headings of the corresponding
+	// sections of the help text, for example to translate them. Each
+	// defaults to the English heading, such as "Options:".
+	PositionalsHeading string
+	OptionsHeading     string
+	GlobalsHeading     string
+	CommandsHeading    string
+	EnvironmentHeading string
 }
 
 // Parser represents a set of command line options with destination values
@@ -131,8 +388,12 @@ type Parser struct {
 	version     string
 	description string
 
-	// the following field changes during processing of command line arguments
-	lastCmd *command
+	// the following fields change during processing of command line arguments
+	lastCmd          *command
+	lastSpecs        []*spec          // options for the chain of commands that were selected
+	givenZero        map[*spec]bool   // options that were given on the command line or environment as their zero value
+	sources          map[*spec]string // where the value of each option came from, for Source
+	extraPositionals []string
 }
 
 // Versioned is the interface that the destination struct should implement to
@@ -151,6 +412,38 @@ type Described interface {
 	Description() string
 }
 
+// Normalizer is the interface that field types may implement to clean up
+// their own values, for example by trimming whitespace. Normalize is called
+// after a value has been set from the command line, environment, or default,
+// and before validation.
+type Normalizer interface {
+	Normalize()
+}
+
+// Runner is the interface that subcommand structs may implement to carry out
+// the subcommand. With Config.AutoRun set, Parse calls Run on the selected
+// subcommand once the command line has been processed.
+type Runner interface {
+	Run() error
+}
+
+// RunError is returned by Parse when Config.AutoRun is set and the Run method
+// of the selected subcommand fails. MustParse reports it without the usage
+// text, since it is not a problem with the command line.
+type RunError struct {
+	Err error
+}
+
+// Error returns the message of the error from Run
+func (e *RunError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error from Run
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
 // walkFields calls a function for each field of a struct, recursively expanding struct fields.
 func walkFields(t reflect.Type, visit func(field reflect.StructField, owner reflect.Type) bool) {
 	walkFieldsImpl(t, visit, nil)
@@ -185,6 +478,10 @@ func NewParser(config Config, dests ...interface{}) (*Parser, error) {
 		name = "program"
 	}
 
+	if config.AutoRun && config.DeferValidation {
+		return nil, errors.New("AutoRun cannot be used with DeferValidation")
+	}
+
 	// construct a parser
 	p := Parser{
 		cmd:    &command{name: name},
@@ -211,7 +508,19 @@ func NewParser(config Config, dests ...interface{}) (*Parser, error) {
 		// add nonzero field values as defaults
 		for _, spec := range cmd.specs {
 			if v := p.val(spec.dest); v.IsValid() && !isZero(v) {
-				if defaultVal, ok := v.Interface().(encoding.TextMarshaler); ok {
+				// initial values take the place of a default from the tag
+				spec.defaultVals = nil
+				if spec.json {
+					str, err := json.Marshal(v.Interface())
+					if err != nil {
+						return nil, fmt.Errorf("%v: error marshaling default value to JSON: %v", spec.dest, err)
+					}
+					spec.defaultVal = string(str)
+				} else if isFlagValue(v.Type()) {
+					spec.defaultVal = flagValueOf(v).String()
+				} else if spec.format != "" && spec.cardinality == one {
+					spec.defaultVal = formatTime(v, spec.format)
+				} else if defaultVal, ok := v.Interface().(encoding.TextMarshaler); ok {
 					str, err := defaultVal.MarshalText()
 					if err != nil {
 						return nil, fmt.Errorf("%v: error marshaling default value to string: %v", spec.dest, err)
@@ -225,6 +534,12 @@ func NewParser(config Config, dests ...interface{}) (*Parser, error) {
 
 		p.cmd.specs = append(p.cmd.specs, cmd.specs...)
 		p.cmd.subcommands = append(p.cmd.subcommands, cmd.subcommands...)
+		if cmd.defaultSubcommand != nil {
+			if p.cmd.defaultSubcommand != nil {
+				return nil, fmt.Errorf("only one subcommand can be the default")
+			}
+			p.cmd.defaultSubcommand = cmd.defaultSubcommand
+		}
 
 		if dest, ok := dest.(Versioned); ok {
 			p.version = dest.Version()
@@ -234,9 +549,43 @@ func NewParser(config Config, dests ...interface{}) (*Parser, error) {
 		}
 	}
 
+	if p.config.OnSpec != nil {
+		p.visitSpecs(p.cmd)
+	}
+
 	return &p, nil
 }
 
+// Clone returns a parser with the same options, subcommands, and
+// configuration as p that stores its results in the given destinations
+// instead. The destinations must be pointers of the same types, and in the
+// same order, as those given to NewParser. Default values are those of the
+// original parser. Each clone keeps its own parsing state, so clones may be
+// used concurrently.
+func (p *Parser) Clone(dests ...interface{}) (*Parser, error) {
+	if len(dests) != len(p.roots) {
+		return nil, fmt.Errorf("expected %d destinations but got %d", len(p.roots), len(dests))
+	}
+
+	clone := Parser{
+		cmd:         p.cmd,
+		config:      p.config,
+		version:     p.version,
+		description: p.description,
+	}
+	for i, dest := range dests {
+		v := reflect.ValueOf(dest)
+		if v.Type() != p.roots[i].Type() {
+			return nil, fmt.Errorf("destination %d is a %v but the parser was built for %v", i, v.Type(), p.roots[i].Type())
+		}
+		if v.IsNil() {
+			return nil, fmt.Errorf("destination %d is nil", i)
+		}
+		clone.roots = append(clone.roots, v)
+	}
+	return &clone, nil
+}
+
 func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 	// commands can only be created from pointers to structs
 	if t.Kind() != reflect.Ptr {
@@ -257,11 +606,23 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 
 	var errs []string
 	walkFields(t, func(field reflect.StructField, t reflect.Type) bool {
-		// check for the ignore switch in the tag
+		// check for the ignore switch in the tag, which still allows the field
+		// to be set from the environment if it has an env tag
 		tag := field.Tag.Get("arg")
-		if tag == "-" {
+		envTagName, hasEnvTag := field.Tag.Lookup("env")
+		if hasEnvTag && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			errs = append(errs, fmt.Sprintf("%s.%s: env tags are not supported for embedded structs",
+				t.Name(), field.Name))
 			return false
 		}
+		var envOnly bool
+		if tag == "-" {
+			if !hasEnvTag {
+				return false
+			}
+			tag = ""
+			envOnly = true
+		}
 
 		// if this is an embedded struct then recurse into its fields, even if
 		// it is unexported, because exported fields on unexported embedded
@@ -283,18 +644,169 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 			long:  strings.ToLower(field.Name),
 		}
 
-		help, exists := field.Tag.Lookup("help")
+		help, exists := helpTag(field)
 		if exists {
 			spec.help = help
 		}
 
 		defaultVal, hasDefault := field.Tag.Lookup("default")
-		if hasDefault {
+		switch {
+		case strings.HasPrefix(defaultVal, "$$"):
+			// a doubled dollar sign escapes a default that starts with "$"
+			spec.defaultVal = defaultVal[1:]
+		case strings.HasPrefix(defaultVal, "$") && isIdentifier(defaultVal[1:]):
+			// a default such as "$Host" names another field, which is
+			// resolved once all fields are known
+			spec.defaultRef = defaultVal[1:]
+		case hasDefault:
 			spec.defaultVal = defaultVal
 		}
 
+		sep, hasSep := field.Tag.Lookup("sep")
+		if hasSep {
+			spec.sep = sep
+		}
+
+		envSep, hasEnvSep := field.Tag.Lookup("envsep")
+		if hasEnvSep {
+			spec.envSep = envSep
+		}
+
+		_, spec.envCSV = field.Tag.Lookup("envcsv")
+
+		if choices, ok := field.Tag.Lookup("choices"); ok {
+			spec.choices = strings.Split(choices, ",")
+		}
+
+		if base, ok := field.Tag.Lookup("base"); ok {
+			switch base {
+			case "2", "8", "10", "16":
+				spec.base, _ = strconv.Atoi(base)
+			default:
+				errs = append(errs, fmt.Sprintf("%s.%s: base must be 2, 8, 10, or 16",
+					t.Name(), field.Name))
+				return false
+			}
+		}
+
+		until, hasUntil := field.Tag.Lookup("until")
+		if hasUntil {
+			spec.until = until
+			if until == "" {
+				spec.until = "--"
+			}
+		}
+
+		if transform, ok := field.Tag.Lookup("transform"); ok {
+			for _, name := range strings.Split(transform, ",") {
+				switch name {
+				case "lower", "upper", "trim":
+					spec.transforms = append(spec.transforms, name)
+				default:
+					errs = append(errs, fmt.Sprintf("%s.%s: unrecognized transform '%s'",
+						t.Name(), field.Name, name))
+					return false
+				}
+			}
+		}
+
+		if pattern, ok := field.Tag.Lookup("pattern"); ok {
+			var err error
+			spec.pattern, err = regexp.Compile(pattern)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s.%s: invalid pattern: %v",
+					t.Name(), field.Name, err))
+				return false
+			}
+		}
+
+		if pathTag, ok := field.Tag.Lookup("path"); ok {
+			for _, name := range strings.Split(pathTag, ",") {
+				switch name {
+				case "exists":
+					spec.pathExists = true
+				case "dir":
+					spec.pathDir = true
+				default:
+					errs = append(errs, fmt.Sprintf("%s.%s: unrecognized path modifier '%s'",
+						t.Name(), field.Name, name))
+					return false
+				}
+			}
+		}
+
+		if format, ok := field.Tag.Lookup("format"); ok {
+			// a layout must contain at least one element of the reference time
+			if format != "unix" && format != "unixmilli" && time.Unix(0, 0).UTC().Format(format) == format {
+				errs = append(errs, fmt.Sprintf("%s.%s: format must be unix, unixmilli, or a time layout",
+					t.Name(), field.Name))
+				return false
+			}
+			spec.format = format
+		}
+
+		for _, bound := range []struct {
+			key  string
+			dest *int
+		}{{"min", &spec.min}, {"max", &spec.max}} {
+			if value, ok := field.Tag.Lookup(bound.key); ok {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					errs = append(errs, fmt.Sprintf("%s.%s: %s must be a positive integer",
+						t.Name(), field.Name, bound.key))
+					return false
+				}
+				*bound.dest = n
+			}
+		}
+		if spec.max != 0 && spec.min > spec.max {
+			errs = append(errs, fmt.Sprintf("%s.%s: min cannot be greater than max",
+				t.Name(), field.Name))
+			return false
+		}
+
+		if choicesCase, ok := field.Tag.Lookup("choicescase"); ok {
+			switch choicesCase {
+			case "fold":
+				spec.foldChoices = true
+			case "exact":
+			default:
+				errs = append(errs, fmt.Sprintf("%s.%s: choicescase must be 'fold' or 'exact'",
+					t.Name(), field.Name))
+				return false
+			}
+		}
+
+		if group, ok := field.Tag.Lookup("group"); ok {
+			parts := strings.Split(group, ",")
+			spec.group = parts[0]
+			for _, part := range parts[1:] {
+				if part != "required" {
+					errs = append(errs, fmt.Sprintf("%s.%s: unrecognized group modifier '%s'",
+						t.Name(), field.Name, part))
+					return false
+				}
+				spec.groupReq = true
+			}
+		}
+
+		if requiredIf, ok := field.Tag.Lookup("requiredif"); ok {
+			pos := strings.Index(requiredIf, "=")
+			if pos == -1 {
+				errs = append(errs, fmt.Sprintf("%s.%s: requiredif must have the form field=value",
+					t.Name(), field.Name))
+				return false
+			}
+			spec.requiredIf = &condition{
+				ref:   requiredIf[:pos],
+				value: requiredIf[pos+1:],
+			}
+		}
+
 		// Look at the tag
 		var isSubcommand bool // tracks whether this field is a subcommand
+		var isDefault bool    // tracks whether this field is the default subcommand
+		var hasLong bool      // tracks whether a long name has been given
 		for _, key := range strings.Split(tag, ",") {
 			if key == "" {
 				continue
@@ -310,7 +822,16 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 			case strings.HasPrefix(key, "---"):
 				errs = append(errs, fmt.Sprintf("%s.%s: too many hyphens", t.Name(), field.Name))
 			case strings.HasPrefix(key, "--"):
-				spec.long = key[2:]
+				// the first long name is canonical and the rest are aliases
+				if hasLong {
+					spec.aliases = append(spec.aliases, key[2:])
+				} else {
+					spec.long = key[2:]
+					hasLong = true
+				}
+			case key == "-":
+				// as with "--", the option has no long name
+				spec.long = ""
 			case strings.HasPrefix(key, "-"):
 				if len(key) != 2 {
 					errs = append(errs, fmt.Sprintf("%s.%s: short arguments must be one character only",
@@ -327,8 +848,30 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 				spec.required = true
 			case key == "positional":
 				spec.positional = true
+			case key == "passthrough":
+				spec.passthrough = true
 			case key == "separate":
 				spec.separate = true
+			case key == "sensitive":
+				spec.sensitive = true
+			case key == "stdin":
+				spec.stdin = true
+			case key == "prompt":
+				spec.prompt = true
+			case key == "json":
+				spec.json = true
+			case key == "dotted":
+				spec.dotted = true
+			case key == "invert":
+				spec.invert = true
+			case key == "unique":
+				spec.unique = true
+			case key == "explicitbool":
+				spec.explicit = true
+			case key == "unknown":
+				spec.unknown = true
+			case key == "default":
+				isDefault = true
 			case key == "help": // deprecated
 				spec.help = value
 			case key == "env":
@@ -353,7 +896,7 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 				}
 
 				subcmd.parent = &cmd
-				subcmd.help = field.Tag.Get("help")
+				subcmd.help, _ = helpTag(field)
 
 				cmd.subcommands = append(cmd.subcommands, subcmd)
 				isSubcommand = true
@@ -363,9 +906,50 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 			}
 		}
 
+		if isDefault {
+			if !isSubcommand {
+				errs = append(errs, fmt.Sprintf("%s.%s: 'default' can only be used with subcommands",
+					t.Name(), field.Name))
+				return false
+			}
+			if cmd.defaultSubcommand != nil {
+				errs = append(errs, fmt.Sprintf("%s.%s: only one subcommand can be the default",
+					t.Name(), field.Name))
+				return false
+			}
+			cmd.defaultSubcommand = cmd.subcommands[len(cmd.subcommands)-1]
+		}
+
+		// an env tag, as in env:"NAME", works like arg:"env:NAME"
+		if hasEnvTag {
+			envName := envTagName
+			if envName == "" {
+				envName = strings.ToUpper(field.Name)
+			}
+			if isSubcommand {
+				errs = append(errs, fmt.Sprintf("%s.%s: env tags are not supported for subcommands",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.env != "" && spec.env != envName {
+				errs = append(errs, fmt.Sprintf("%s.%s: env tag %q conflicts with environment variable %q from the arg tag",
+					t.Name(), field.Name, envName, spec.env))
+				return false
+			}
+			spec.env = envName
+		}
+		if envOnly {
+			spec.long = ""
+			spec.short = ""
+		}
+
 		placeholder, hasPlaceholder := field.Tag.Lookup("placeholder")
 		if hasPlaceholder {
 			spec.placeholder = placeholder
+		} else if elem := sliceElem(field.Type); isTuple(elem) {
+			spec.placeholder = tuplePlaceholder(elem)
+		} else if elem.Kind() == reflect.Map && !spec.json {
+			spec.placeholder = "KEY=VALUE"
 		} else if spec.long != "" {
 			spec.placeholder = strings.ToUpper(spec.long)
 		} else {
@@ -381,13 +965,138 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 
 			var err error
 			spec.cardinality, err = cardinalityOf(field.Type)
+			if spec.json {
+				// any type can be decoded from a single JSON document
+				spec.cardinality, err = one, nil
+			}
+			if spec.dotted {
+				if field.Type.Kind() != reflect.Struct || canParse(field.Type) {
+					errs = append(errs, fmt.Sprintf("%s.%s: dotted is only supported for struct fields",
+						t.Name(), field.Name))
+					return false
+				}
+				spec.cardinality, err = multiple, nil
+			}
 			if err != nil {
 				errs = append(errs, fmt.Sprintf("%s.%s: %s fields are not supported",
 					t.Name(), field.Name, field.Type.String()))
 				return false
 			}
+			if spec.stdin {
+				// a []byte read from standard input is a single value
+				if !isStdinType(field.Type) {
+					errs = append(errs, fmt.Sprintf("%s.%s: stdin is only supported for string and []byte fields",
+						t.Name(), field.Name))
+					return false
+				}
+				spec.cardinality = one
+			}
+			if spec.prompt && (!spec.sensitive || spec.cardinality != one) {
+				errs = append(errs, fmt.Sprintf("%s.%s: prompt is only supported for sensitive fields with a single value",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.invert && !isBoolean(field.Type) {
+				errs = append(errs, fmt.Sprintf("%s.%s: invert is only supported for boolean fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.explicit && !isBoolean(field.Type) {
+				errs = append(errs, fmt.Sprintf("%s.%s: explicitbool is only supported for boolean fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.unique && (spec.cardinality != multiple || sliceElem(field.Type).Kind() == reflect.Map) {
+				errs = append(errs, fmt.Sprintf("%s.%s: unique is only supported for slice fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if (spec.min != 0 || spec.max != 0) && (spec.cardinality != multiple || sliceElem(field.Type).Kind() == reflect.Map) {
+				errs = append(errs, fmt.Sprintf("%s.%s: min and max are only supported for slice fields",
+					t.Name(), field.Name))
+				return false
+			}
 			if spec.cardinality == multiple && hasDefault {
-				errs = append(errs, fmt.Sprintf("%s.%s: default values are not supported for slice or map fields",
+				if sliceElem(field.Type).Kind() == reflect.Map {
+					errs = append(errs, fmt.Sprintf("%s.%s: default values are not supported for map fields",
+						t.Name(), field.Name))
+					return false
+				}
+				spec.defaultVals = strings.Fields(spec.defaultVal)
+				if spec.sep != "" {
+					spec.defaultVals, err = splitValues([]string{spec.defaultVal}, spec.sep)
+					if err != nil {
+						errs = append(errs, fmt.Sprintf("%s.%s: invalid default: %v",
+							t.Name(), field.Name, err))
+						return false
+					}
+				}
+			}
+			if spec.passthrough {
+				if spec.cardinality != multiple || spec.positional {
+					errs = append(errs, fmt.Sprintf("%s.%s: passthrough fields must be slices and cannot be positional",
+						t.Name(), field.Name))
+					return false
+				}
+				spec.long = ""
+				spec.short = ""
+			}
+			if spec.unknown {
+				if spec.positional || sliceElem(field.Type).Kind() != reflect.Map || field.Type.Kind() == reflect.Slice {
+					errs = append(errs, fmt.Sprintf("%s.%s: unknown fields must be maps and cannot be positional",
+						t.Name(), field.Name))
+					return false
+				}
+				spec.long = ""
+				spec.short = ""
+			}
+			if hasSep && (spec.cardinality != multiple || sep == "") {
+				errs = append(errs, fmt.Sprintf("%s.%s: sep must be non-empty and is only supported for slice or map fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if len(spec.choices) > 0 && sliceElem(field.Type).Kind() == reflect.Map {
+				errs = append(errs, fmt.Sprintf("%s.%s: choices are not supported for map fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.base != 0 && (spec.cardinality != one || !isInteger(field.Type)) {
+				errs = append(errs, fmt.Sprintf("%s.%s: base is only supported for integer fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if hasUntil && (spec.cardinality != multiple || spec.positional || spec.separate) {
+				errs = append(errs, fmt.Sprintf("%s.%s: until is only supported for slice and map options that are not positional or separate",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.pattern != nil && elemKind(field.Type) != reflect.String {
+				errs = append(errs, fmt.Sprintf("%s.%s: pattern is only supported for string fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if (spec.pathExists || spec.pathDir) && elemKind(field.Type) != reflect.String {
+				errs = append(errs, fmt.Sprintf("%s.%s: path is only supported for string fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if len(spec.transforms) > 0 && elemKind(field.Type) != reflect.String {
+				errs = append(errs, fmt.Sprintf("%s.%s: transform is only supported for string fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.format != "" && !isTime(sliceElem(field.Type)) {
+				errs = append(errs, fmt.Sprintf("%s.%s: format is only supported for time.Time fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if hasEnvSep && (spec.cardinality != multiple || envSep == "") {
+				errs = append(errs, fmt.Sprintf("%s.%s: envsep must be non-empty and is only supported for slice or map fields",
+					t.Name(), field.Name))
+				return false
+			}
+			if spec.envCSV && (spec.cardinality != multiple || hasEnvSep) {
+				errs = append(errs, fmt.Sprintf("%s.%s: envcsv is only supported for slice or map fields without envsep",
 					t.Name(), field.Name))
 				return false
 			}
@@ -397,32 +1106,128 @@ func cmdFromStruct(name string, dest path, t reflect.Type) (*command, error) {
 		return false
 	})
 
+	// resolve the fields referred to by requiredif conditions
+	for _, spec := range cmd.specs {
+		if spec.requiredIf == nil {
+			continue
+		}
+		spec.requiredIf.spec = findSibling(cmd.specs, spec.requiredIf.ref)
+		if spec.requiredIf.spec == nil {
+			errs = append(errs, fmt.Sprintf("%s: requiredif refers to unknown field %q",
+				spec.dest, spec.requiredIf.ref))
+		}
+	}
+
+	// resolve the fields referred to by defaults such as "$Host"
+	for _, spec := range cmd.specs {
+		if spec.defaultRef == "" {
+			continue
+		}
+		spec.defaultFrom = findSibling(cmd.specs, spec.defaultRef)
+		if spec.defaultFrom == nil {
+			errs = append(errs, fmt.Sprintf("%s.%s: default refers to unknown field %q (write \"$$\" for a literal \"$\")",
+				t.Name(), spec.field.Name, spec.defaultRef))
+			continue
+		}
+		if spec.cardinality == multiple {
+			errs = append(errs, fmt.Sprintf("%s.%s: the default of a slice field cannot refer to another field",
+				t.Name(), spec.field.Name))
+			continue
+		}
+		if spec.defaultFrom.cardinality != one {
+			errs = append(errs, fmt.Sprintf("%s.%s: default refers to %q, which is not a single value",
+				t.Name(), spec.field.Name, spec.defaultRef))
+		}
+	}
+
+	// check that defaults do not refer to one another in a cycle
+	for _, spec := range cmd.specs {
+		for ref, n := spec.defaultFrom, 0; ref != nil && n < len(cmd.specs); ref, n = ref.defaultFrom, n+1 {
+			if ref == spec {
+				errs = append(errs, fmt.Sprintf("%s.%s: default refers back to itself through %q",
+					t.Name(), spec.field.Name, spec.defaultRef))
+				break
+			}
+		}
+	}
+
 	if len(errs) > 0 {
 		return nil, errors.New(strings.Join(errs, "\n"))
 	}
 
-	// check that we don't have both positionals and subcommands
-	var hasPositional bool
+	// check that a slice positional, which consumes all remaining
+	// positionals unless it has a max, comes last and is not followed by
+	// subcommands
+	var slicePositional, unboundedPositional *spec
 	for _, spec := range cmd.specs {
-		if spec.positional {
-			hasPositional = true
+		if !spec.positional {
+			continue
+		}
+		if unboundedPositional != nil {
+			return nil, fmt.Errorf("a slice positional must be the final positional (field %s)", unboundedPositional.field.Name)
+		}
+		if spec.cardinality == multiple {
+			slicePositional = spec
+			if spec.max == 0 {
+				unboundedPositional = spec
+			}
 		}
 	}
-	if hasPositional && len(cmd.subcommands) > 0 {
-		return nil, fmt.Errorf("%s cannot have both subcommands and positional arguments", dest)
+	if slicePositional != nil && len(cmd.subcommands) > 0 {
+		return nil, fmt.Errorf("%s cannot have both subcommands and a slice positional argument", dest)
 	}
 
 	return &cmd, nil
 }
 
 // Parse processes the given command line option, storing the results in the field
-// of the structs from which NewParser was constructed
+// of the structs from which NewParser was constructed. If args is nil then
+// Config.Args is used instead.
 func (p *Parser) Parse(args []string) error {
-	err := p.process(args)
+	return p.parse(args, nil)
+}
+
+// ParseStream is like Parse except that positional arguments are passed to
+// onPositional one at a time, in order, rather than being stored in
+// positional fields. This avoids holding very long lists of positional
+// arguments in memory. If onPositional returns an error then parsing stops
+// and that error is returned.
+func (p *Parser) ParseStream(args []string, onPositional func(string) error) error {
+	return p.parse(args, onPositional)
+}
+
+// parse implements Parse and ParseStream
+func (p *Parser) parse(args []string, onPositional func(string) error) error {
+	if args == nil {
+		args = p.config.Args
+	}
+	if len(args) == 0 && p.config.ArgsEnv != "" {
+		var err error
+		args, err = splitCommandLine(os.Getenv(p.config.ArgsEnv))
+		if err != nil {
+			p.lastCmd = p.cmd
+			return fmt.Errorf("error reading arguments from environment variable %s: %v", p.config.ArgsEnv, err)
+		}
+	}
+	if p.config.PreProcess != nil {
+		args = p.config.PreProcess(args)
+	}
+	if p.config.ExpandEnv {
+		args = expandEnv(args)
+	}
+	err := p.process(args, onPositional)
+	if err == nil && p.config.AutoRun {
+		if runner, ok := p.Subcommand().(Runner); ok {
+			if err := runner.Run(); err != nil {
+				return &RunError{Err: err}
+			}
+			return nil
+		}
+	}
 	if err != nil {
 		// If -h or --help were specified then make sure help text supercedes other errors
 		for _, arg := range args {
-			if arg == "-h" || arg == "--help" {
+			if p.isHelpFlag(p.activeSpecs(), arg) {
 				return ErrHelp
 			}
 			if arg == "--" {
@@ -433,10 +1238,159 @@ func (p *Parser) Parse(args []string) error {
 	return err
 }
 
+// expandEnv replaces ${VAR} and $VAR in each argument with the value of the
+// environment variable, leaving the arguments after "--" untouched
+func expandEnv(args []string) []string {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			copy(expanded[i:], args[i:])
+			break
+		}
+		expanded[i] = os.ExpandEnv(arg)
+	}
+	return expanded
+}
+
+// splitCommandLine splits s into arguments in the manner of a shell:
+// arguments are separated by whitespace, single quotes preserve everything
+// up to the closing quote, double quotes do the same except that a backslash
+// escapes the next character, and outside quotes a backslash also escapes the
+// next character
+func splitCommandLine(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	var inArg bool
+	var quote rune
+	var escaped bool
+	for _, c := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case quote == '"':
+			switch c {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// ExtraPositionals returns the positional arguments that were left over after
+// all positional fields were filled. It is only populated when
+// Config.AllowExtraPositionals is set; otherwise leftover positionals cause
+// Parse to fail.
+func (p *Parser) ExtraPositionals() []string {
+	return p.extraPositionals
+}
+
+// helpFlags returns the arguments that request help, leaving out any that
+// the program has declared as its own options among the given specs, which
+// are those of the commands selected so far
+func (p *Parser) helpFlags(specs []*spec) []string {
+	flags := p.config.HelpFlags
+	if flags == nil {
+		flags = []string{"-h", "--help"}
+	}
+
+	var unshadowed []string
+	for _, flag := range flags {
+		if !isDeclared(specs, flag) {
+			unshadowed = append(unshadowed, flag)
+		}
+	}
+	return unshadowed
+}
+
+// hasLong returns true if name is the long name of the option or one of its
+// aliases
+func (s *spec) hasLong(name string) bool {
+	if name == "" {
+		return false
+	}
+	if s.long == name {
+		return true
+	}
+	for _, alias := range s.aliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeclared returns true if one of the options in specs is spelled flag
+func isDeclared(specs []*spec, flag string) bool {
+	for _, spec := range specs {
+		if spec.positional {
+			continue
+		}
+		if (strings.HasPrefix(flag, "--") && spec.hasLong(flag[2:])) || (spec.short != "" && flag == "-"+spec.short) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHelpFlag returns true if the argument requests help
+func (p *Parser) isHelpFlag(specs []*spec, arg string) bool {
+	for _, flag := range p.helpFlags(specs) {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// envVar returns the environment variable from which the option is read, or
+// the empty string if there is none or Config.NoEnvForRequired rules it out
+func (p *Parser) envVar(spec *spec) string {
+	if spec.required && p.config.NoEnvForRequired {
+		return ""
+	}
+	return spec.env
+}
+
 // process environment vars for the given arguments
 func (p *Parser) captureEnvVars(specs []*spec, wasPresent map[*spec]bool) error {
 	for _, spec := range specs {
-		if spec.env == "" {
+		if p.envVar(spec) == "" {
 			continue
 		}
 
@@ -446,11 +1400,15 @@ func (p *Parser) captureEnvVars(specs []*spec, wasPresent map[*spec]bool) error
 		}
 
 		if spec.cardinality == multiple {
-			// expect a CSV string in an environment
-			// variable in the case of multiple values
+			// split an environment variable holding multiple values on
+			// whitespace, unless a separator was given with envsep, or
+			// parse it as CSV if it has an envcsv tag
 			var values []string
 			var err error
-			if len(strings.TrimSpace(value)) > 0 {
+			switch {
+			case len(strings.TrimSpace(value)) == 0:
+				// an empty variable clears the slice or map
+			case spec.envCSV:
 				values, err = csv.NewReader(strings.NewReader(value)).Read()
 				if err != nil {
 					return fmt.Errorf(
@@ -459,34 +1417,42 @@ func (p *Parser) captureEnvVars(specs []*spec, wasPresent map[*spec]bool) error
 						err,
 					)
 				}
+			case spec.envSep == "" || strings.TrimSpace(spec.envSep) == "":
+				values = strings.Fields(value)
+			default:
+				values = strings.Split(value, spec.envSep)
 			}
-			if err = setSliceOrMap(p.val(spec.dest), values, !spec.separate); err != nil {
+			if err = p.setValues(spec, values, !spec.separate); err != nil {
 				return fmt.Errorf(
-					"error processing environment variable %s with multiple values: %v",
+					"error processing environment variable %s with multiple values: %w",
 					spec.env,
-					err,
+					redact(spec, err, values...),
 				)
 			}
 		} else {
-			if err := scalar.ParseValue(p.val(spec.dest), value); err != nil {
-				return fmt.Errorf("error processing environment variable %s: %v", spec.env, err)
+			if err := p.setGivenValue(spec, value); err != nil {
+				return fmt.Errorf("error processing environment variable %s: %w", spec.env, redact(spec, err, value))
 			}
 		}
 		wasPresent[spec] = true
+		p.sources[spec] = SourceEnv
 	}
 
 	return nil
 }
 
 // process goes through arguments one-by-one, parses them, and assigns the result to
-// the underlying struct field
-func (p *Parser) process(args []string) error {
+// the underlying struct field. If onPositional is not nil then positional
+// arguments are passed to it instead of being assigned to positional fields.
+func (p *Parser) process(args []string, onPositional func(string) error) error {
 	// track the options we have seen
 	wasPresent := make(map[*spec]bool)
+	p.sources = make(map[*spec]string)
 
 	// union of specs for the chain of subcommands encountered so far
 	curCmd := p.cmd
 	p.lastCmd = curCmd
+	p.extraPositionals = nil
 
 	// make a copy of the specs because we will add to this list each time we expand a subcommand
 	specs := make([]*spec, len(curCmd.specs))
@@ -500,80 +1466,183 @@ func (p *Parser) process(args []string) error {
 		}
 	}
 
+	// the number of positionals seen since the current command was selected
+	var cmdPositionals, numPositionals int
+
+	// enter selects a subcommand of the current command
+	enter := func(subcmd *command) error {
+		// instantiate the field to point to a new struct
+		v := p.val(subcmd.dest)
+		v.Set(reflect.New(v.Type().Elem())) // we already checked that all subcommands are struct pointers
+
+		// add the new options to the set of allowed options
+		specs = append(specs, subcmd.specs...)
+
+		// capture environment vars for these new options
+		if !p.config.IgnoreEnv {
+			err := p.captureEnvVars(subcmd.specs, wasPresent)
+			if err != nil {
+				return err
+			}
+		}
+
+		curCmd = subcmd
+		p.lastCmd = curCmd
+		cmdPositionals = 0
+		return nil
+	}
+
 	// process each string from the command line
-	var allpositional bool
-	var positionals []string
+	var allpositional, envHelp bool
+	var positionals, passthrough []string
+
+	// errors are reported in a fixed order of precedence regardless of the
+	// order of the arguments: unknown or malformed arguments first, which are
+	// returned as soon as they are seen, then options missing their values,
+	// then missing required options and other validation failures, and last
+	// the wrong number of positionals
+	var missingErr, countErr error
 
 	// must use explicit for loop, not range, because we manipulate i inside the loop
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
+		if allpositional && findPassthrough(specs) != nil {
+			passthrough = append(passthrough, arg)
+			continue
+		}
 		if arg == "--" {
 			allpositional = true
 			continue
 		}
 
 		if !isFlag(arg) || allpositional {
-			// each subcommand can have either subcommands or positionals, but not both
-			if len(curCmd.subcommands) == 0 {
+			// positionals for the current command come before its subcommand
+			if len(curCmd.subcommands) == 0 || cmdPositionals < curCmd.numPositionals() {
+				cmdPositionals++
+				numPositionals++
+				if p.config.MaxPositionals > 0 && numPositionals > p.config.MaxPositionals {
+					if countErr == nil {
+						countErr = fmt.Errorf("too many positional arguments at '%s' (at most %d allowed)", arg, p.config.MaxPositionals)
+					}
+					continue
+				}
+				if onPositional != nil {
+					if err := onPositional(arg); err != nil {
+						return err
+					}
+					continue
+				}
 				positionals = append(positionals, arg)
 				continue
 			}
 
 			// if we have a subcommand then make sure it is valid for the current context
 			subcmd := findSubcommand(curCmd.subcommands, arg)
-			if subcmd == nil {
-				return fmt.Errorf("invalid subcommand: %s", arg)
+			if subcmd == nil && p.config.AllowAbbrevSubcommands {
+				matches := findSubcommandsWithPrefix(curCmd.subcommands, arg)
+				if len(matches) > 1 {
+					var names []string
+					for _, match := range matches {
+						names = append(names, match.name)
+					}
+					return fmt.Errorf("ambiguous subcommand %s: could be %s", arg, strings.Join(names, ", "))
+				}
+				if len(matches) == 1 {
+					subcmd = matches[0]
+				}
 			}
-
-			// instantiate the field to point to a new struct
-			v := p.val(subcmd.dest)
-			v.Set(reflect.New(v.Type().Elem())) // we already checked that all subcommands are struct pointers
-
-			// add the new options to the set of allowed options
-			specs = append(specs, subcmd.specs...)
-
-			// capture environment vars for these new options
-			if !p.config.IgnoreEnv {
-				err := p.captureEnvVars(subcmd.specs, wasPresent)
-				if err != nil {
+			if subcmd == nil && curCmd.defaultSubcommand != nil {
+				// enter the default subcommand and process this argument again
+				if err := enter(curCmd.defaultSubcommand); err != nil {
 					return err
 				}
+				i--
+				continue
+			}
+			if subcmd == nil {
+				return fmt.Errorf("invalid subcommand: %s", arg)
 			}
 
-			curCmd = subcmd
-			p.lastCmd = curCmd
+			if err := enter(subcmd); err != nil {
+				return err
+			}
 			continue
 		}
 
 		// check for special --help and --version flags
-		switch arg {
-		case "-h", "--help":
+		if p.isHelpFlag(specs, arg) {
 			return ErrHelp
-		case "--version":
+		}
+		if arg == "--version" && p.version != "" {
 			return ErrVersion
 		}
-
-		// check for an equals sign, as in "--foo=bar"
-		var value string
-		opt := strings.TrimLeft(arg, "-")
-		if pos := strings.Index(opt, "="); pos != -1 {
-			value = opt[pos+1:]
-			opt = opt[:pos]
+		if p.config.EnvHelpFlag != "" && arg == p.config.EnvHelpFlag {
+			envHelp = true
+			continue
 		}
 
 		// lookup the spec for this option (note that the "specs" slice changes as
 		// we expand subcommands so it is better not to use a map)
-		spec := findOption(specs, opt)
+		spec, value := p.lookupOption(specs, arg)
+		if spec != nil && spec.sensitive && value != "" {
+			// do not show the value in error messages
+			arg = arg[:len(arg)-len(value)] + redacted
+		}
+		if spec == nil && curCmd.defaultSubcommand != nil {
+			// the option may belong to the default subcommand
+			if err := enter(curCmd.defaultSubcommand); err != nil {
+				return err
+			}
+			i--
+			continue
+		}
+		if catchall := findCatchAll(specs); spec == nil && catchall != nil && strings.HasPrefix(arg, "--") {
+			// collect the unrecognized option, with the value attached to it
+			// or else the next argument if that is not itself an option
+			key, value := arg[2:], ""
+			if pos, n := p.valueSeparator(arg, key); pos != -1 {
+				key, value = key[:pos], key[pos+n:]
+			} else if i+1 < len(args) && !isFlag(args[i+1]) && args[i+1] != "--" {
+				value = args[i+1]
+				i++
+			}
+			err := p.setValues(catchall, []string{key + "=" + value}, !wasPresent[catchall])
+			if err != nil {
+				return fmt.Errorf("error processing %s: %w", arg, err)
+			}
+			wasPresent[catchall] = true
+			p.sources[catchall] = SourceCommandLine
+			continue
+		}
+		if spec == nil && arg == "--version" {
+			// without a version, --version is an ordinary argument, which
+			// this program does not declare
+			return errors.New("--version is not supported because this program has no version")
+		}
 		if spec == nil {
 			return fmt.Errorf("unknown argument %s", arg)
 		}
 		wasPresent[spec] = true
+		p.sources[spec] = SourceCommandLine
 
 		// deal with the case of multiple values
 		if spec.cardinality == multiple {
 			var values []string
-			if value == "" {
-				for i+1 < len(args) && !isFlag(args[i+1]) && args[i+1] != "--" {
+			if value == "" && spec.until != "" {
+				// collect every value up to the sentinel, which is dropped,
+				// and then carry on with the arguments after it
+				for i+1 < len(args) {
+					i++
+					if args[i] == spec.until {
+						break
+					}
+					values = append(values, args[i])
+				}
+			} else if value == "" {
+				// collect values up to the next flag, treating negative numbers
+				// as values when the slice holds numbers
+				elem := sliceElem(spec.field.Type)
+				for i+1 < len(args) && !p.endsValues(specs, elem, args[i+1]) {
 					values = append(values, args[i+1])
 					i++
 					if spec.separate {
@@ -583,9 +1652,16 @@ func (p *Parser) process(args []string) error {
 			} else {
 				values = append(values, value)
 			}
-			err := setSliceOrMap(p.val(spec.dest), values, !spec.separate)
+			if spec.sep != "" {
+				var err error
+				values, err = splitValues(values, spec.sep)
+				if err != nil {
+					return fmt.Errorf("error processing %s: %w", arg, redact(spec, err, value))
+				}
+			}
+			err := p.setValues(spec, values, !spec.separate)
 			if err != nil {
-				return fmt.Errorf("error processing %s: %v", arg, err)
+				return fmt.Errorf("error processing %s: %w", arg, redact(spec, err, values...))
 			}
 			continue
 		}
@@ -593,24 +1669,50 @@ func (p *Parser) process(args []string) error {
 		// if it's a flag and it has no value then set the value to true
 		// use boolean because this takes account of TextUnmarshaler
 		if spec.cardinality == zero && value == "" {
+			if spec.explicit {
+				if missingErr == nil {
+					missingErr = fmt.Errorf("%s requires a value", arg)
+				}
+				continue
+			}
 			value = "true"
 		}
 
 		// if we have something like "--foo" then the value is the next argument
 		if value == "" {
-			if i+1 == len(args) {
-				return fmt.Errorf("missing value for %s", arg)
-			}
-			if !nextIsNumeric(spec.field.Type, args[i+1]) && isFlag(args[i+1]) {
-				return fmt.Errorf("missing value for %s", arg)
+			if i+1 == len(args) || !nextIsNumeric(spec.field.Type, args[i+1]) && !nextIsInBase(spec, args[i+1]) && isFlag(args[i+1]) {
+				if missingErr == nil {
+					missingErr = fmt.Errorf("missing value for %s", arg)
+				}
+				continue
 			}
 			value = args[i+1]
 			i++
 		}
 
-		err := scalar.ParseValue(p.val(spec.dest), value)
+		err := p.setGivenValue(spec, value)
 		if err != nil {
-			return fmt.Errorf("error processing %s: %v", arg, err)
+			return fmt.Errorf("error processing %s: %w", arg, redact(spec, err, value))
+		}
+	}
+	if missingErr != nil {
+		return missingErr
+	}
+
+	// if no subcommand was given then use the default, if there is one
+	for curCmd.defaultSubcommand != nil {
+		if err := enter(curCmd.defaultSubcommand); err != nil {
+			return err
+		}
+	}
+
+	// process arguments after "--"
+	if spec := findPassthrough(specs); spec != nil && len(passthrough) > 0 {
+		wasPresent[spec] = true
+		p.sources[spec] = SourceCommandLine
+		err := p.setValues(spec, passthrough, true)
+		if err != nil {
+			return fmt.Errorf("error processing %s: %w", spec.field.Name, err)
 		}
 	}
 
@@ -623,51 +1725,198 @@ func (p *Parser) process(args []string) error {
 			break
 		}
 		wasPresent[spec] = true
+		p.sources[spec] = SourceCommandLine
 		if spec.cardinality == multiple {
-			err := setSliceOrMap(p.val(spec.dest), positionals, true)
+			// a slice with a maximum leaves any further values to the
+			// positionals that follow it
+			values := positionals
+			if n := spec.max * tokensPerValue(spec); n != 0 && len(values) > n {
+				values = values[:n]
+			}
+			err := p.setValues(spec, values, true)
 			if err != nil {
-				return fmt.Errorf("error processing %s: %v", spec.field.Name, err)
+				return fmt.Errorf("error processing %s: %w", spec.field.Name, redact(spec, err, values...))
 			}
-			positionals = nil
+			positionals = positionals[len(values):]
 		} else {
-			err := scalar.ParseValue(p.val(spec.dest), positionals[0])
+			err := p.setGivenValue(spec, positionals[0])
 			if err != nil {
-				return fmt.Errorf("error processing %s: %v", spec.field.Name, err)
+				return fmt.Errorf("error processing %s: %w", spec.field.Name, redact(spec, err, positionals[0]))
 			}
 			positionals = positionals[1:]
 		}
 	}
 	if len(positionals) > 0 {
-		return fmt.Errorf("too many positional arguments at '%s'", positionals[0])
+		switch {
+		case p.config.AllowExtraPositionals:
+			p.extraPositionals = positionals
+		case countErr != nil:
+		case !hasPositionals(specs):
+			countErr = fmt.Errorf("this command takes no positional arguments, got '%s'", positionals[0])
+		default:
+			countErr = fmt.Errorf("too many positional arguments at '%s'", positionals[0])
+		}
 	}
 
-	// fill in defaults and check that all the required args were provided
+	// ask for anything still missing, unless parsing is bound to fail anyway
+	if p.config.AllowPrompt && countErr == nil && !envHelp {
+		if err := p.prompt(specs, wasPresent); err != nil {
+			return err
+		}
+	}
+
+	// fill in defaults
 	for _, spec := range specs {
-		if wasPresent[spec] {
+		if wasPresent[spec] || spec.required || spec.defaultVal == "" {
 			continue
 		}
+		var err error
+		switch {
+		case spec.cardinality != multiple:
+			err = p.setValue(spec, spec.defaultVal)
+		case spec.defaultVals != nil:
+			err = p.setValues(spec, spec.defaultVals, true)
+		}
+		// otherwise this is a slice that still holds its initial values
+		if err != nil {
+			return fmt.Errorf("error processing default value for %s: %w", spec.name(), err)
+		}
+		p.sources[spec] = SourceDefault
+	}
 
-		name := strings.ToLower(spec.field.Name)
-		if spec.long != "" && !spec.positional {
-			name = "--" + spec.long
+	// fill in defaults that copy the value of another field, once that field
+	// has its own value
+	resolved := make(map[*spec]bool)
+	var copyDefault func(spec *spec) error
+	copyDefault = func(spec *spec) error {
+		if resolved[spec] || wasPresent[spec] || spec.required || spec.defaultFrom == nil || spec.defaultVal != "" {
+			return nil
+		}
+		resolved[spec] = true
+		if err := copyDefault(spec.defaultFrom); err != nil {
+			return err
+		}
+		v := p.val(spec.defaultFrom.dest)
+		if !v.IsValid() || isZero(v) {
+			return nil
+		}
+		if err := p.setValue(spec, formatValue(v)); err != nil {
+			return fmt.Errorf("error processing default value for %s: %w", spec.name(), err)
+		}
+		p.sources[spec] = SourceDefault
+		return nil
+	}
+	for _, spec := range specs {
+		if err := copyDefault(spec); err != nil {
+			return err
 		}
+	}
 
-		if spec.required {
-			msg := fmt.Sprintf("%s is required", name)
-			if spec.env != "" {
-				msg += " (or environment variable " + spec.env + ")"
-			}
-			return errors.New(msg)
+	// keep track of what was seen so that Validate can be run later
+	p.lastSpecs = specs
+	p.givenZero = make(map[*spec]bool)
+	for spec := range wasPresent {
+		if v := p.val(spec.dest); v.IsValid() && isZero(v) {
+			p.givenZero[spec] = true
 		}
-		if spec.defaultVal != "" {
-			err := scalar.ParseValue(p.val(spec.dest), spec.defaultVal)
-			if err != nil {
-				return fmt.Errorf("error processing default value for %s: %v", name, err)
-			}
+	}
+	if envHelp {
+		return ErrEnvHelp
+	}
+	if !p.config.DeferValidation {
+		if err := p.validate(specs, wasPresent); err != nil {
+			return err
 		}
 	}
+	return countErr
+}
 
-	return nil
+// tokensPerValue returns the number of command line tokens that make up each
+// value of the option, which is more than one for slices of tuples
+func tokensPerValue(spec *spec) int {
+	if elem := sliceElem(spec.field.Type); isTuple(elem) {
+		return elem.NumField()
+	}
+	return 1
+}
+
+// lookupOption finds the option named by arg, which begins with a dash, and
+// returns it along with any value attached to it, as in "--foo=bar" or
+// "-eEXPR". The option is nil if arg does not name any of specs.
+func (p *Parser) lookupOption(specs []*spec, arg string) (*spec, string) {
+	// check for an equals sign, as in "--foo=bar"
+	var value string
+	opt := strings.TrimLeft(arg, "-")
+	if pos, n := p.valueSeparator(arg, opt); pos != -1 {
+		value = opt[pos+n:]
+		opt = opt[:pos]
+	}
+
+	spec := findOption(specs, opt)
+	if p.config.StrictDashes {
+		spec = findOptionWithDashes(specs, opt, len(arg)-len(strings.TrimLeft(arg, "-")))
+	} else if spec != nil && spec.long == "" && strings.HasPrefix(arg, "--") {
+		// options declared without a long name cannot be written as one
+		spec = nil
+	}
+	if spec == nil && len(arg) > 2 && arg[0] == '-' && arg[1] != '-' && !p.config.DisableClustering {
+		// a short option may be followed directly by its value, as in "-eEXPR"
+		short := findOptionWithDashes(specs, arg[1:2], 1)
+		if short != nil && short.cardinality != zero {
+			spec, value = short, arg[2:]
+		}
+	}
+	return spec, value
+}
+
+// endsValues returns true if arg ends the list of values being collected for
+// a slice option whose elements have type elem. By default any flag other
+// than a negative number does so, but with Config.SliceStopAtKnownFlag only
+// the options in specs and the help and version flags do.
+func (p *Parser) endsValues(specs []*spec, elem reflect.Type, arg string) bool {
+	if arg == "--" {
+		return true
+	}
+	if !isFlag(arg) || nextIsNumeric(elem, arg) {
+		return false
+	}
+	if !p.config.SliceStopAtKnownFlag {
+		return true
+	}
+	if p.isHelpFlag(specs, arg) || (arg == "--version" && p.version != "") {
+		return true
+	}
+	spec, _ := p.lookupOption(specs, arg)
+	return spec != nil
+}
+
+// nextIsInBase returns true if the option is parsed in an explicit base and
+// s is an integer in that base
+func nextIsInBase(spec *spec, s string) bool {
+	if spec.base == 0 {
+		return false
+	}
+	_, err := strconv.ParseInt(s, spec.base, 64)
+	return err == nil
+}
+
+// valueSeparator finds the separator between the name and the value in
+// opt, which is arg with its leading dashes removed. It returns the position
+// and length of the separator, or -1 if there is none. Long options use the
+// first of Config.LongValueSeparators to appear in opt.
+func (p *Parser) valueSeparator(arg, opt string) (int, int) {
+	seps := []string{"="}
+	if p.config.LongValueSeparators != nil && strings.HasPrefix(arg, "--") {
+		seps = p.config.LongValueSeparators
+	}
+
+	pos, n := -1, 0
+	for _, sep := range seps {
+		if i := strings.Index(opt, sep); sep != "" && i != -1 && (pos == -1 || i < pos) {
+			pos, n = i, len(sep)
+		}
+	}
+	return pos, n
 }
 
 func nextIsNumeric(t reflect.Type, s string) bool {
@@ -683,6 +1932,38 @@ func nextIsNumeric(t reflect.Type, s string) bool {
 	}
 }
 
+// helpTag returns the help text for a field from its "help" tag or, failing
+// that, its "doc" tag
+func helpTag(field reflect.StructField) (string, bool) {
+	if help, ok := field.Tag.Lookup("help"); ok {
+		return help, true
+	}
+	return field.Tag.Lookup("doc")
+}
+
+// sliceElem returns the element type of a slice or pointer to slice, or the
+// type itself for any other type
+func sliceElem(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice {
+		return t.Elem()
+	}
+	return t
+}
+
+// isIdentifier returns true if s has the form of a Go identifier, such as the
+// name of a field
+func isIdentifier(s string) bool {
+	for i, c := range s {
+		if c != '_' && !unicode.IsLetter(c) && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // isFlag returns true if a token is a flag such as "-v" or "--user" but not "-" or "--"
 func isFlag(s string) bool {
 	return strings.HasPrefix(s, "-") && strings.TrimLeft(s, "-") != ""
@@ -711,7 +1992,53 @@ func findOption(specs []*spec, name string) *spec {
 		if spec.positional {
 			continue
 		}
-		if spec.long == name || spec.short == name {
+		if spec.hasLong(name) || spec.short == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// findOptionWithDashes is like findOption except that long names must be
+// preceded by exactly two dashes and short names by exactly one
+func findOptionWithDashes(specs []*spec, name string, dashes int) *spec {
+	for _, spec := range specs {
+		if spec.positional {
+			continue
+		}
+		if (dashes == 2 && spec.hasLong(name)) || (dashes == 1 && spec.short == name) {
+			return spec
+		}
+	}
+	return nil
+}
+
+// hasPositionals returns true if any of the specs is a positional argument
+func hasPositionals(specs []*spec) bool {
+	for _, spec := range specs {
+		if spec.positional {
+			return true
+		}
+	}
+	return false
+}
+
+// findCatchAll finds the option that receives unrecognized options, or
+// returns nil if there is none
+func findCatchAll(specs []*spec) *spec {
+	for _, spec := range specs {
+		if spec.unknown {
+			return spec
+		}
+	}
+	return nil
+}
+
+// findPassthrough finds the option that receives arguments after "--", or
+// returns null if there is none
+func findPassthrough(specs []*spec) *spec {
+	for _, spec := range specs {
+		if spec.passthrough {
 			return spec
 		}
 	}
@@ -727,3 +2054,15 @@ func findSubcommand(cmds []*command, name string) *command {
 	}
 	return nil
 }
+
+// findSubcommandsWithPrefix returns the subcommands whose names begin with
+// the given prefix
+func findSubcommandsWithPrefix(cmds []*command, prefix string) []*command {
+	var matches []*command
+	for _, cmd := range cmds {
+		if strings.HasPrefix(cmd.name, prefix) {
+			matches = append(matches, cmd)
+		}
+	}
+	return matches
+}
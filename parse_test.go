@@ -2,12 +2,15 @@ package arg
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"net/mail"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -158,6 +161,54 @@ func TestInvalidDuration(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestDurationSlice(t *testing.T) {
+	var args struct {
+		Timeouts []time.Duration
+	}
+	err := parse("--timeouts 1s 2s 500ms", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 500 * time.Millisecond}, args.Timeouts)
+}
+
+func TestInvalidDurationSlice(t *testing.T) {
+	var args struct {
+		Timeouts []time.Duration
+	}
+	err := parse("--timeouts 1s xxx", &args)
+	require.Error(t, err)
+}
+
+// byteSize is a size with an optional K, M, or G suffix
+type byteSize int64
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := string(text)
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, s[:len(s)-1]
+	case strings.HasSuffix(s, "G"):
+		mult, s = 1<<30, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+func TestByteSizeSlice(t *testing.T) {
+	var args struct {
+		Limits []byteSize
+	}
+	err := parse("--limits 512 4K 2M", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []byteSize{512, 4 << 10, 2 << 20}, args.Limits)
+}
+
 func TestIntPtr(t *testing.T) {
 	var args struct {
 		Foo *int
@@ -211,6 +262,55 @@ func TestRequiredWithEnv(t *testing.T) {
 	require.Error(t, err, "--foo is required (or environment variable FOO)")
 }
 
+func TestNoEnvForRequired(t *testing.T) {
+	var args struct {
+		Token string `arg:"required,env:TOKEN" help:"API token"`
+		Host  string `arg:"env:HOST"`
+	}
+	setenv(t, "TOKEN", "secret")
+	setenv(t, "HOST", "example.com")
+	defer os.Unsetenv("TOKEN")
+	defer os.Unsetenv("HOST")
+	p, err := NewParser(Config{Program: "example", NoEnvForRequired: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse(nil)
+	assert.EqualError(t, err, "--token is required")
+	assert.Equal(t, "", args.Token)
+	assert.Equal(t, "example.com", args.Host)
+
+	err = p.Parse([]string{"--token", "abc"})
+	require.NoError(t, err)
+	assert.Equal(t, "abc", args.Token)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "\n  --token TOKEN          API token (required)\n")
+	assert.Contains(t, help.String(), "\n  --host HOST [env: HOST]\n")
+}
+
+func TestMapValueWithEquals(t *testing.T) {
+	var args struct {
+		Values map[string]string
+		Query  map[string]string `arg:"separate"`
+	}
+	err := parse("--values key=a=b=c --query=q=x=1&y=2", &args)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "a=b=c"}, args.Values)
+	assert.Equal(t, map[string]string{"q": "x=1&y=2"}, args.Query)
+}
+
+func TestURLValues(t *testing.T) {
+	var args struct {
+		Param url.Values `arg:"separate"`
+		Query url.Values
+	}
+	err := parse("--param q=go --param page=2 --param q=arg --query a=1 a=2", &args)
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{"q": {"go", "arg"}, "page": {"2"}}, args.Param)
+	assert.Equal(t, url.Values{"a": {"1", "2"}}, args.Query)
+}
+
 func TestShortFlag(t *testing.T) {
 	var args struct {
 		Foo string `arg:"-f"`
@@ -328,6 +428,53 @@ func TestNoLongName(t *testing.T) {
 	assert.Equal(t, "TestVal2", args.ShortOnly)
 }
 
+func TestLongAliases(t *testing.T) {
+	var args struct {
+		Color string `arg:"--color,--colour" help:"when to use color"`
+	}
+	err := parse("--color always", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "always", args.Color)
+
+	err = parse("--colour=never", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "never", args.Color)
+
+	args.Color = ""
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, "Usage: example [--color COLOR]\n", usage.String())
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "\n  --color COLOR, --colour COLOR\n                         when to use color\n")
+}
+
+func TestShortOnlyRejectsLongForm(t *testing.T) {
+	var args struct {
+		X string `arg:"-x,-"`
+		Y string `arg:"-y,--"`
+	}
+	err := parse("-x 1 -y 2", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "1", args.X)
+	assert.Equal(t, "2", args.Y)
+
+	err = parse("--x 1", &args)
+	assert.EqualError(t, err, "unknown argument --x")
+
+	err = parse("--y 2", &args)
+	assert.EqualError(t, err, "unknown argument --y")
+
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, "Usage: example [-x X] [-y Y]\n", usage.String())
+}
+
 func TestCaseSensitive(t *testing.T) {
 	var args struct {
 		Lower bool `arg:"-v"`
@@ -394,6 +541,37 @@ func TestRequiredPositionalMultiple(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPositionalBool(t *testing.T) {
+	var args struct {
+		Enable bool `arg:"positional"`
+		Debug  bool
+	}
+	err := parse("yes --debug=off", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Enable)
+	assert.False(t, args.Debug)
+}
+
+func TestSlicePositionalMustBeLast(t *testing.T) {
+	var args struct {
+		Inputs []string `arg:"positional"`
+		Output string   `arg:"positional"`
+	}
+	err := parse("a b c", &args)
+	assert.EqualError(t, err, "a slice positional must be the final positional (field Inputs)")
+}
+
+func TestSlicePositionalLast(t *testing.T) {
+	var args struct {
+		Output string   `arg:"positional"`
+		Inputs []string `arg:"positional"`
+	}
+	err := parse("a b c", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "a", args.Output)
+	assert.Equal(t, []string{"b", "c"}, args.Inputs)
+}
+
 func TestTooManyPositional(t *testing.T) {
 	var args struct {
 		Input  string `arg:"positional"`
@@ -403,6 +581,144 @@ func TestTooManyPositional(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPositionalWithoutPositionalFields(t *testing.T) {
+	var args struct {
+		Verbose bool
+	}
+	err := parse("--verbose foo", &args)
+	assert.EqualError(t, err, "this command takes no positional arguments, got 'foo'")
+
+	p, err := NewParser(Config{AllowExtraPositionals: true}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"foo"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, p.ExtraPositionals())
+}
+
+func TestExtraPositionalsDisallowed(t *testing.T) {
+	var args struct {
+		Input string `arg:"positional"`
+	}
+	p, err := pparse("foo bar baz", &args)
+	assert.EqualError(t, err, "too many positional arguments at 'bar'")
+	assert.Nil(t, p.ExtraPositionals())
+}
+
+func TestExtraPositionalsAllowed(t *testing.T) {
+	var args struct {
+		Input   string `arg:"positional"`
+		Verbose bool
+	}
+	p, err := NewParser(Config{AllowExtraPositionals: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"foo", "bar", "--verbose", "baz"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", args.Input)
+	assert.True(t, args.Verbose)
+	assert.Equal(t, []string{"bar", "baz"}, p.ExtraPositionals())
+
+	err = p.Parse([]string{"foo"})
+	require.NoError(t, err)
+	assert.Nil(t, p.ExtraPositionals())
+}
+
+func TestPassthrough(t *testing.T) {
+	var args struct {
+		Input string   `arg:"positional"`
+		Args  []string `arg:"passthrough"`
+		Debug bool
+	}
+	err := parse("--debug foo -- --bar baz -- qux", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Debug)
+	assert.Equal(t, "foo", args.Input)
+	assert.Equal(t, []string{"--bar", "baz", "--", "qux"}, args.Args)
+}
+
+func TestPassthroughNotAnOption(t *testing.T) {
+	var args struct {
+		Args []string `arg:"passthrough"`
+	}
+	err := parse("--args x", &args)
+	assert.EqualError(t, err, "unknown argument --args")
+}
+
+func TestPassthroughMustBeSlice(t *testing.T) {
+	var args struct {
+		Args string `arg:"passthrough"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".Args: passthrough fields must be slices and cannot be positional")
+}
+
+func TestParseStream(t *testing.T) {
+	var args struct {
+		Verbose bool
+		Prefix  string
+		Files   []string `arg:"positional"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	var got []string
+	err = p.ParseStream([]string{"a", "--verbose", "b", "--prefix", "x", "c", "--", "--d"}, func(s string) error {
+		got = append(got, s)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "--d"}, got)
+	assert.True(t, args.Verbose)
+	assert.Equal(t, "x", args.Prefix)
+	assert.Nil(t, args.Files)
+}
+
+func TestParseStreamCallbackError(t *testing.T) {
+	var args struct {
+		Verbose bool
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	err = p.ParseStream([]string{"a", "stop", "--verbose"}, func(s string) error {
+		if s == "stop" {
+			return errors.New("stopped")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "stopped")
+	assert.False(t, args.Verbose)
+}
+
+func TestPositionalTuples(t *testing.T) {
+	type copyPair struct {
+		Src string
+		Dst string
+	}
+	var args struct {
+		Force bool
+		Files []copyPair `arg:"positional"`
+	}
+	err := parse("a.txt b.txt --force c.txt d.txt", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Force)
+	assert.Equal(t, []copyPair{{"a.txt", "b.txt"}, {"c.txt", "d.txt"}}, args.Files)
+}
+
+func TestPositionalTuplesIncomplete(t *testing.T) {
+	var args struct {
+		Pairs []struct {
+			Name  string
+			Count int
+		} `arg:"positional"`
+	}
+	err := parse("a 1 b", &args)
+	assert.EqualError(t, err, "error processing Pairs: expected values in groups of 2 but got 3 values")
+
+	err = parse("a b", &args)
+	assert.Error(t, err)
+}
+
 func TestMultiple(t *testing.T) {
 	var args struct {
 		Foo []int
@@ -414,6 +730,31 @@ func TestMultiple(t *testing.T) {
 	assert.Equal(t, []string{"x", "y", "z"}, args.Bar)
 }
 
+func TestMultipleNegativeNumbers(t *testing.T) {
+	var args struct {
+		Nums []int
+		Xs   []*float64
+		V    bool `arg:"-v"`
+	}
+	err := parse("--nums 1 -2 3 --xs -1.5 2 -v", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, -2, 3}, args.Nums)
+	require.Len(t, args.Xs, 2)
+	assert.Equal(t, -1.5, *args.Xs[0])
+	assert.True(t, args.V)
+}
+
+func TestMultipleStringsStopAtDash(t *testing.T) {
+	var args struct {
+		Names []string
+		N     int `arg:"--2"`
+	}
+	err := parse("--names a b -2 5", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, args.Names)
+	assert.Equal(t, 5, args.N)
+}
+
 func TestMultiplePositionals(t *testing.T) {
 	var args struct {
 		Input    string   `arg:"positional"`
@@ -501,6 +842,72 @@ func TestMissingValueInMiddle(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestErrorPrecedence(t *testing.T) {
+	type argsType struct {
+		Name    string `arg:"required"`
+		Level   int
+		Verbose bool
+		Input   string `arg:"positional"`
+	}
+
+	// an unknown argument wins over everything else, wherever it appears
+	for _, cmdline := range []string{
+		"--level --bogus a b",
+		"a b --bogus --level",
+		"--bogus a b --level",
+	} {
+		var args argsType
+		err := parse(cmdline, &args)
+		assert.EqualError(t, err, "unknown argument --bogus", cmdline)
+	}
+
+	// then a missing value
+	for _, cmdline := range []string{
+		"--level --verbose a b",
+		"a b --level",
+		"--verbose a --level --verbose b",
+	} {
+		var args argsType
+		err := parse(cmdline, &args)
+		assert.EqualError(t, err, "missing value for --level", cmdline)
+	}
+
+	// then a missing required option
+	for _, cmdline := range []string{
+		"a b",
+		"a --level 3 b",
+	} {
+		var args argsType
+		err := parse(cmdline, &args)
+		assert.EqualError(t, err, "--name is required", cmdline)
+	}
+
+	// and last the positionals
+	var args argsType
+	err := parse("a b --name x", &args)
+	assert.EqualError(t, err, "too many positional arguments at 'b'")
+}
+
+func TestErrorPrecedenceMaxPositionals(t *testing.T) {
+	var args struct {
+		Name  string   `arg:"required"`
+		Files []string `arg:"positional"`
+	}
+	p, err := NewParser(Config{MaxPositionals: 1}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"a", "b"})
+	assert.EqualError(t, err, "--name is required")
+
+	args.Files = nil
+	err = p.Parse([]string{"a", "b", "--name"})
+	assert.EqualError(t, err, "missing value for --name")
+
+	args.Files = nil
+	err = p.Parse([]string{"a", "b", "--name", "x"})
+	assert.EqualError(t, err, "too many positional arguments at 'b' (at most 1 allowed)")
+}
+
 func TestNegativeValue(t *testing.T) {
 	var args struct {
 		Foo int
@@ -594,6 +1001,144 @@ func TestHelpFlag(t *testing.T) {
 	assert.Equal(t, ErrHelp, err)
 }
 
+func TestCustomHelpFlags(t *testing.T) {
+	var args struct {
+		Foo string
+	}
+	p, err := NewParser(Config{HelpFlags: []string{"--usage", "-?"}}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--usage"})
+	assert.Equal(t, ErrHelp, err)
+
+	err = p.Parse([]string{"--foo", "x", "-?"})
+	assert.Equal(t, ErrHelp, err)
+
+	err = p.Parse([]string{"--help"})
+	assert.EqualError(t, err, "unknown argument --help")
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "\n  --usage, -?            display this help and exit\n")
+}
+
+func TestHelpFlagsDisabled(t *testing.T) {
+	var args struct {
+		Foo string
+	}
+	p, err := NewParser(Config{HelpFlags: []string{}}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"-h"})
+	assert.EqualError(t, err, "unknown argument -h")
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.NotContains(t, help.String(), "display this help")
+}
+
+func TestUserDefinedHelpFlag(t *testing.T) {
+	var args struct {
+		Help string `arg:"--help" help:"topic to explain"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--help", "colors"})
+	require.NoError(t, err)
+	assert.Equal(t, "colors", args.Help)
+
+	err = p.Parse([]string{"-h"})
+	assert.Equal(t, ErrHelp, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "\n  --help HELP            topic to explain\n")
+	assert.Contains(t, help.String(), "\n  -h                     display this help and exit\n")
+}
+
+func TestUserDefinedShortHelpFlag(t *testing.T) {
+	var args struct {
+		Host string `arg:"-h"`
+	}
+	err := parse("-h example.com", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", args.Host)
+
+	err = parse("--help", &args)
+	assert.Equal(t, ErrHelp, err)
+}
+
+func TestSubcommandShortHelpFlag(t *testing.T) {
+	var args struct {
+		Connect *struct {
+			Host string `arg:"-h"`
+		} `arg:"subcommand"`
+		List *struct{} `arg:"subcommand"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"connect", "-h", "example.com"})
+	require.NoError(t, err)
+	require.NotNil(t, args.Connect)
+	assert.Equal(t, "example.com", args.Connect.Host)
+
+	err = p.Parse([]string{"connect", "--help"})
+	assert.Equal(t, ErrHelp, err)
+
+	// -h still asks for help before the subcommand and in other subcommands
+	err = p.Parse([]string{"-h", "connect"})
+	assert.Equal(t, ErrHelp, err)
+	err = p.Parse([]string{"list", "-h"})
+	assert.Equal(t, ErrHelp, err)
+
+	var help bytes.Buffer
+	require.NoError(t, p.WriteHelpForSubcommand(&help, "connect"))
+	assert.Contains(t, help.String(), "\n  --help                 display this help and exit\n")
+	help.Reset()
+	require.NoError(t, p.WriteHelpForSubcommand(&help, "list"))
+	assert.Contains(t, help.String(), "\n  --help, -h             display this help and exit\n")
+}
+
+func TestRemappedShortHelpFlag(t *testing.T) {
+	var args struct {
+		Host string `arg:"-h"`
+	}
+	p, err := NewParser(Config{Program: "example", HelpFlags: []string{"-?", "--help"}}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"-h", "example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", args.Host)
+
+	err = p.Parse([]string{"-?"})
+	assert.Equal(t, ErrHelp, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "\n  --help, -?             display this help and exit\n")
+}
+
+func TestRemappedShortHelpFlagCollision(t *testing.T) {
+	var args struct {
+		Query bool `arg:"-?"`
+	}
+	p, err := NewParser(Config{Program: "example", HelpFlags: []string{"-?", "--help"}}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"-?"})
+	require.NoError(t, err)
+	assert.True(t, args.Query)
+
+	err = p.Parse([]string{"--help"})
+	assert.Equal(t, ErrHelp, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "\n  --help                 display this help and exit\n")
+}
+
 func TestPanicOnNonPointer(t *testing.T) {
 	var args struct{}
 	assert.Panics(t, func() {
@@ -723,7 +1268,7 @@ func TestEnvironmentVariableRequired(t *testing.T) {
 
 func TestEnvironmentVariableSliceArgumentString(t *testing.T) {
 	var args struct {
-		Foo []string `arg:"env"`
+		Foo []string `arg:"env" envcsv:""`
 	}
 	_, err := parseWithEnv("", []string{`FOO=bar,"baz, qux"`}, &args)
 	require.NoError(t, err)
@@ -741,7 +1286,7 @@ func TestEnvironmentVariableSliceEmpty(t *testing.T) {
 
 func TestEnvironmentVariableSliceArgumentInteger(t *testing.T) {
 	var args struct {
-		Foo []int `arg:"env"`
+		Foo []int `arg:"env" envcsv:""`
 	}
 	_, err := parseWithEnv("", []string{`FOO=1,99`}, &args)
 	require.NoError(t, err)
@@ -750,7 +1295,7 @@ func TestEnvironmentVariableSliceArgumentInteger(t *testing.T) {
 
 func TestEnvironmentVariableSliceArgumentFloat(t *testing.T) {
 	var args struct {
-		Foo []float32 `arg:"env"`
+		Foo []float32 `arg:"env" envcsv:""`
 	}
 	_, err := parseWithEnv("", []string{`FOO=1.1,99.9`}, &args)
 	require.NoError(t, err)
@@ -759,7 +1304,7 @@ func TestEnvironmentVariableSliceArgumentFloat(t *testing.T) {
 
 func TestEnvironmentVariableSliceArgumentBool(t *testing.T) {
 	var args struct {
-		Foo []bool `arg:"env"`
+		Foo []bool `arg:"env" envcsv:""`
 	}
 	_, err := parseWithEnv("", []string{`FOO=true,false,0,1`}, &args)
 	require.NoError(t, err)
@@ -768,7 +1313,7 @@ func TestEnvironmentVariableSliceArgumentBool(t *testing.T) {
 
 func TestEnvironmentVariableSliceArgumentWrongCsv(t *testing.T) {
 	var args struct {
-		Foo []int `arg:"env"`
+		Foo []int `arg:"env" envcsv:""`
 	}
 	_, err := parseWithEnv("", []string{`FOO=1,99\"`}, &args)
 	assert.Error(t, err)
@@ -776,37 +1321,162 @@ func TestEnvironmentVariableSliceArgumentWrongCsv(t *testing.T) {
 
 func TestEnvironmentVariableSliceArgumentWrongType(t *testing.T) {
 	var args struct {
-		Foo []bool `arg:"env"`
+		Foo []bool `arg:"env" envcsv:""`
 	}
 	_, err := parseWithEnv("", []string{`FOO=one,two`}, &args)
 	assert.Error(t, err)
 }
 
-func TestEnvironmentVariableMap(t *testing.T) {
+func TestEnvironmentVariableSliceDefaultSeparator(t *testing.T) {
 	var args struct {
-		Foo map[int]string `arg:"env"`
+		Foo []string       `arg:"env"`
+		Bar map[string]int `arg:"env"`
 	}
-	_, err := parseWithEnv("", []string{`FOO=1=one,99=ninetynine`}, &args)
+	_, err := parseWithEnv("", []string{"FOO=a,b  c\td", "BAR=x=1 y=2"}, &args)
 	require.NoError(t, err)
-	assert.Len(t, args.Foo, 2)
-	assert.Equal(t, "one", args.Foo[1])
-	assert.Equal(t, "ninetynine", args.Foo[99])
+	assert.Equal(t, []string{"a,b", "c", "d"}, args.Foo)
+	assert.Equal(t, map[string]int{"x": 1, "y": 2}, args.Bar)
 }
 
-func TestEnvironmentVariableEmptyMap(t *testing.T) {
+func TestEnvironmentVariableSliceWithSeparator(t *testing.T) {
 	var args struct {
-		Foo map[int]string `arg:"env"`
+		Paths []string `arg:"env" envsep:":"`
 	}
-	_, err := parseWithEnv("", []string{`FOO=`}, &args)
+	_, err := parseWithEnv("", []string{"PATHS=/a:/b,c:/d"}, &args)
 	require.NoError(t, err)
-	assert.Len(t, args.Foo, 0)
+	assert.Equal(t, []string{"/a", "/b,c", "/d"}, args.Paths)
 }
 
-func TestEnvironmentVariableIgnored(t *testing.T) {
+func TestEnvironmentVariableSliceWithWhitespaceSeparator(t *testing.T) {
 	var args struct {
-		Foo string `arg:"env"`
+		Ports []int `arg:"env" envsep:" "`
 	}
-	setenv(t, "FOO", "abc")
+	_, err := parseWithEnv("", []string{"PORTS= 80  443\t8080 "}, &args)
+	require.NoError(t, err)
+	assert.Equal(t, []int{80, 443, 8080}, args.Ports)
+}
+
+func TestEnvSepNotAllowedOnScalar(t *testing.T) {
+	var args struct {
+		Foo string `arg:"env" envsep:":"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".Foo: envsep must be non-empty and is only supported for slice or map fields")
+}
+
+func TestEnvCSVInvalid(t *testing.T) {
+	var args1 struct {
+		Foo string `arg:"env" envcsv:""`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, ".Foo: envcsv is only supported for slice or map fields without envsep")
+
+	var args2 struct {
+		Foo []string `arg:"env" envcsv:"" envsep:";"`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, ".Foo: envcsv is only supported for slice or map fields without envsep")
+}
+
+func TestEnvSepLiteralCSV(t *testing.T) {
+	var args struct {
+		Foo []string `arg:"env" envsep:"csv"`
+	}
+	_, err := parseWithEnv("", []string{"FOO=acsvbcsvc"}, &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, args.Foo)
+}
+
+func TestEnvironmentOnly(t *testing.T) {
+	var args struct {
+		Secret string `arg:"-" env:"ENV_ONLY_SECRET"`
+		Count  int    `arg:"-" env:""`
+	}
+	_, err := parseWithEnv("", []string{"ENV_ONLY_SECRET=hunter2", "COUNT=3"}, &args)
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", args.Secret)
+	assert.Equal(t, 3, args.Count)
+}
+
+func TestEnvironmentOnlyNotOnCommandLine(t *testing.T) {
+	var args struct {
+		Secret string `arg:"-" env:"ENV_ONLY_SECRET2"`
+	}
+	err := parse("--secret x", &args)
+	assert.EqualError(t, err, "unknown argument --secret")
+
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.NotContains(t, help.String(), "secret")
+}
+
+func TestEnvTagOnOption(t *testing.T) {
+	var args struct {
+		Host string `env:"SERVER_HOST"`
+		Port int    `arg:"-p,env:PORT" env:"PORT"`
+		User string `env:""`
+	}
+	_, err := parseWithEnv("", []string{"SERVER_HOST=example.com", "PORT=8080", "USER=me"}, &args)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", args.Host)
+	assert.Equal(t, 8080, args.Port)
+	assert.Equal(t, "me", args.User)
+
+	_, err = parseWithEnv("--host other.com", []string{"SERVER_HOST=example.com"}, &args)
+	require.NoError(t, err)
+	assert.Equal(t, "other.com", args.Host)
+}
+
+func TestEnvTagInvalid(t *testing.T) {
+	var args1 struct {
+		Port int `arg:"env:PORT" env:"SERVER_PORT"`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, `.Port: env tag "SERVER_PORT" conflicts with environment variable "PORT" from the arg tag`)
+
+	var args2 struct {
+		Serve *struct{} `arg:"subcommand" env:"SERVE"`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, ".Serve: env tags are not supported for subcommands")
+}
+
+func TestIgnoredFieldWithoutEnv(t *testing.T) {
+	var args struct {
+		Secret string `arg:"-"`
+	}
+	_, err := parseWithEnv("", []string{"SECRET=x"}, &args)
+	require.NoError(t, err)
+	assert.Equal(t, "", args.Secret)
+}
+
+func TestEnvironmentVariableMap(t *testing.T) {
+	var args struct {
+		Foo map[int]string `arg:"env" envcsv:""`
+	}
+	_, err := parseWithEnv("", []string{`FOO=1=one,99=ninetynine`}, &args)
+	require.NoError(t, err)
+	assert.Len(t, args.Foo, 2)
+	assert.Equal(t, "one", args.Foo[1])
+	assert.Equal(t, "ninetynine", args.Foo[99])
+}
+
+func TestEnvironmentVariableEmptyMap(t *testing.T) {
+	var args struct {
+		Foo map[int]string `arg:"env"`
+	}
+	_, err := parseWithEnv("", []string{`FOO=`}, &args)
+	require.NoError(t, err)
+	assert.Len(t, args.Foo, 0)
+}
+
+func TestEnvironmentVariableIgnored(t *testing.T) {
+	var args struct {
+		Foo string `arg:"env"`
+	}
+	setenv(t, "FOO", "abc")
 
 	p, err := NewParser(Config{IgnoreEnv: true}, &args)
 	require.NoError(t, err)
@@ -1259,6 +1929,128 @@ func TestSeparatePositionalInterweaved(t *testing.T) {
 	assert.Equal(t, []string{"post1", "post2", "post3"}, args.Post)
 }
 
+func TestNestedMap(t *testing.T) {
+	var args struct {
+		Set map[string]interface{} `arg:"separate"`
+	}
+	err := parse("--set a.b=1 --set a.c=2", &args)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{"b": "1", "c": "2"},
+	}, args.Set)
+}
+
+type dbSettings struct {
+	Host string
+	Port int
+}
+
+type settings struct {
+	DB    dbSettings
+	Cache *dbSettings
+	Extra map[string]interface{}
+	Debug bool
+}
+
+func TestDottedStruct(t *testing.T) {
+	var args struct {
+		Set settings `arg:"separate,dotted"`
+	}
+	err := parse("--set db.host=localhost --set db.port=5432 --set cache.host=mem --set extra.a.b=1 --set Debug=true", &args)
+	require.NoError(t, err)
+	assert.Equal(t, dbSettings{Host: "localhost", Port: 5432}, args.Set.DB)
+	require.NotNil(t, args.Set.Cache)
+	assert.Equal(t, "mem", args.Set.Cache.Host)
+	assert.Equal(t, map[string]interface{}{"a": map[string]interface{}{"b": "1"}}, args.Set.Extra)
+	assert.True(t, args.Set.Debug)
+}
+
+func TestDottedStructInvalidPath(t *testing.T) {
+	var args struct {
+		Set settings `arg:"separate,dotted"`
+	}
+	err := parse("--set db.user=x", &args)
+	assert.EqualError(t, err, `error processing --set: cannot set "db.user" because arg.dbSettings has no field "user"`)
+
+	err = parse("--set db.host.name=x", &args)
+	assert.EqualError(t, err, `error processing --set: cannot set "db.host.name" because "db.host" is not a struct`)
+
+	err = parse("--set db=x", &args)
+	assert.EqualError(t, err, `error processing --set: cannot set "db" because it is a struct, set its fields instead`)
+
+	err = parse("--set db..host=x", &args)
+	assert.EqualError(t, err, `error processing --set: invalid field path "db..host"`)
+
+	err = parse("--set db.port=abc", &args)
+	assert.Error(t, err)
+
+	var bad struct {
+		Set map[string]int `arg:"dotted"`
+	}
+	err = parse("", &bad)
+	assert.EqualError(t, err, ".Set: dotted is only supported for struct fields")
+}
+
+func TestSepBool(t *testing.T) {
+	var args struct {
+		Flags []bool `sep:","`
+	}
+	err := parse("--flags=true,false,true", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true}, args.Flags)
+}
+
+func TestSepInt(t *testing.T) {
+	var args struct {
+		Ports []int `sep:","`
+	}
+	err := parse("--ports 80,443 8080", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []int{80, 443, 8080}, args.Ports)
+}
+
+func TestSepDuration(t *testing.T) {
+	var args struct {
+		Timeouts []time.Duration `sep:","`
+	}
+	err := parse("--timeouts=1s,500ms", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second, 500 * time.Millisecond}, args.Timeouts)
+}
+
+func TestSepWithSeparate(t *testing.T) {
+	var args struct {
+		Ports []int `arg:"-p,separate" sep:","`
+	}
+	err := parse("-p 80,443 -p=8080", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []int{80, 443, 8080}, args.Ports)
+}
+
+func TestSepEmptyPiece(t *testing.T) {
+	var args struct {
+		Ports []int `sep:","`
+	}
+	err := parse("--ports=80,,443", &args)
+	assert.EqualError(t, err, `error processing --ports=80,,443: empty value in "80,,443" (separator is ",")`)
+}
+
+func TestSepInvalidElement(t *testing.T) {
+	var args struct {
+		Flags []bool `sep:","`
+	}
+	err := parse("--flags=true,nope", &args)
+	assert.Error(t, err)
+}
+
+func TestSepNotAllowedOnScalar(t *testing.T) {
+	var args struct {
+		Foo string `sep:","`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".Foo: sep must be non-empty and is only supported for slice or map fields")
+}
+
 func TestSpacesAllowedInTags(t *testing.T) {
 	var args struct {
 		Foo []string `arg:"--foo, -f, separate, required, help:quite nice really"`
@@ -1286,10 +2078,22 @@ func TestReuseParser(t *testing.T) {
 }
 
 func TestVersion(t *testing.T) {
-	var args struct{}
+	var args versioned
 	err := parse("--version", &args)
 	assert.Equal(t, ErrVersion, err)
+}
 
+func TestVersionNotConfigured(t *testing.T) {
+	var args struct{}
+	err := parse("--version", &args)
+	assert.EqualError(t, err, "--version is not supported because this program has no version")
+
+	var withField struct {
+		Version bool
+	}
+	err = parse("--version", &withField)
+	require.NoError(t, err)
+	assert.True(t, withField.Version)
 }
 
 func TestMultipleTerminates(t *testing.T) {
@@ -1363,6 +2167,85 @@ func TestDefaultPositionalValues(t *testing.T) {
 	assert.True(t, args.G)
 }
 
+func TestSepMap(t *testing.T) {
+	var args struct {
+		Values map[string]string `sep:","`
+		Limits map[string]int    `sep:","`
+	}
+	err := parse("--values one=two,three=four --limits a=1,b=2 c=3", &args)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"one": "two", "three": "four"}, args.Values)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2, "c": 3}, args.Limits)
+
+	err = parse("--values one=two,three", &args)
+	assert.Error(t, err)
+}
+
+func TestSepMapSingleToken(t *testing.T) {
+	var args struct {
+		Opt map[string]string `sep:","`
+	}
+	err := parse("--opt=a=1,b=2,c=x=y", &args)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "c": "x=y"}, args.Opt)
+
+	err = parse("--opt a=1,,b=2", &args)
+	assert.EqualError(t, err, `error processing --opt: empty value in "a=1,,b=2" (separator is ",")`)
+
+	err = parse("--opt a=1,b", &args)
+	assert.EqualError(t, err, `error processing --opt: cannot parse "b" into a map, expected format key=value`)
+}
+
+func TestUnknownOptionsMap(t *testing.T) {
+	var args struct {
+		Verbose bool
+		Forward map[string]string `arg:"unknown"`
+		Target  string            `arg:"positional"`
+	}
+	err := parse("--timeout 5 --verbose --mode=fast --dry-run -- host", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Verbose)
+	assert.Equal(t, map[string]string{"timeout": "5", "mode": "fast", "dry-run": ""}, args.Forward)
+	assert.Equal(t, "host", args.Target)
+
+	err = parse("-x", &args)
+	assert.EqualError(t, err, "unknown argument -x")
+}
+
+func TestUnknownOptionsURLValues(t *testing.T) {
+	var args struct {
+		Params url.Values `arg:"unknown"`
+	}
+	err := parse("--tag a --tag=b --page 2", &args)
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{"tag": {"a", "b"}, "page": {"2"}}, args.Params)
+}
+
+func TestUnknownOptionsInvalid(t *testing.T) {
+	var args struct {
+		Forward []string `arg:"unknown"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".Forward: unknown fields must be maps and cannot be positional")
+}
+
+func TestTrailingPositionalDefault(t *testing.T) {
+	var args struct {
+		Input  string `arg:"positional,required"`
+		Output string `arg:"positional" default:"."`
+	}
+
+	err := parse("in.txt", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "in.txt", args.Input)
+	assert.Equal(t, ".", args.Output)
+
+	args.Output = ""
+	err = parse("in.txt out", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "out", args.Output)
+}
+
 func TestDefaultValuesNotAllowedWithRequired(t *testing.T) {
 	var args struct {
 		A int `arg:"required" default:"123"` // required not allowed with default!
@@ -1372,13 +2255,158 @@ func TestDefaultValuesNotAllowedWithRequired(t *testing.T) {
 	assert.EqualError(t, err, ".A: 'required' cannot be used when a default value is specified")
 }
 
-func TestDefaultValuesNotAllowedWithSlice(t *testing.T) {
+func TestDefaultValuesNotAllowedWithMap(t *testing.T) {
+	var args struct {
+		A map[string]int `default:"a=123"`
+	}
+
+	err := parse("", &args)
+	assert.EqualError(t, err, ".A: default values are not supported for map fields")
+}
+
+func TestDefaultSlice(t *testing.T) {
+	var args struct {
+		Ports []int    `default:"80  443 8080"`
+		Tags  []string `default:"a,b c" sep:","`
+		Files []string `arg:"positional" default:"in.txt"`
+	}
+	err := parse("", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []int{80, 443, 8080}, args.Ports)
+	assert.Equal(t, []string{"a", "b c"}, args.Tags)
+	assert.Equal(t, []string{"in.txt"}, args.Files)
+
+	err = parse("a.txt b.txt --ports 22 --tags x", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []int{22}, args.Ports)
+	assert.Equal(t, []string{"x"}, args.Tags)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, args.Files)
+}
+
+func TestDefaultSliceHelp(t *testing.T) {
+	var args struct {
+		Ports []int `default:"80 443"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "--ports PORTS [default: 80 443]")
+}
+
+func TestDefaultSliceInvalid(t *testing.T) {
+	var args1 struct {
+		Ports []int `default:"80 http"`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, `error processing default value for --ports: strconv.ParseInt: parsing "http": invalid syntax`)
+
+	var args2 struct {
+		Tags []string `default:"a,,b" sep:","`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, `.Tags: invalid default: empty value in "a,,b" (separator is ",")`)
+
+	var args3 struct {
+		Tags []string `default:"$Name"`
+		Name string
+	}
+	err = parse("", &args3)
+	assert.EqualError(t, err, ".Tags: the default of a slice field cannot refer to another field")
+}
+
+func TestInitialSliceValues(t *testing.T) {
 	var args struct {
-		A []int `default:"123"` // required not allowed with default!
+		Names []string `default:"x y"`
+		Sizes map[string]int
+	}
+	args.Names = []string{"a", "b"}
+	args.Sizes = map[string]int{"a": 1}
+	err := parse("", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, args.Names)
+	assert.Equal(t, map[string]int{"a": 1}, args.Sizes)
+
+	err = parse("--names c", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, args.Names)
+}
+
+func TestDefaultFromField(t *testing.T) {
+	type argsType struct {
+		Host       string `default:"localhost"`
+		ListenHost string `default:"$Host"`
+		PublicHost string `default:"$ListenHost"`
+		Port       int    `default:"$Backlog"`
+		Backlog    int
+		Home       string   `default:"$HOME/x"`
+		Paths      []string `default:"$HOME/a $HOME/b"`
+		Price      string   `default:"$5"`
+		Currency   string   `default:"$$USD"`
 	}
 
+	var args argsType
 	err := parse("", &args)
-	assert.EqualError(t, err, ".A: default values are not supported for slice or map fields")
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", args.ListenHost)
+	assert.Equal(t, "localhost", args.PublicHost)
+	assert.Equal(t, 0, args.Port)
+	assert.Equal(t, "$HOME/x", args.Home)
+	assert.Equal(t, []string{"$HOME/a", "$HOME/b"}, args.Paths)
+	assert.Equal(t, "$5", args.Price)
+	assert.Equal(t, "$USD", args.Currency)
+
+	args = argsType{}
+	err = parse("--host example.com --backlog 8", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", args.ListenHost)
+	assert.Equal(t, "example.com", args.PublicHost)
+	assert.Equal(t, 8, args.Port)
+
+	args = argsType{}
+	err = parse("--host example.com --listenhost 0.0.0.0", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "0.0.0.0", args.ListenHost)
+	assert.Equal(t, "0.0.0.0", args.PublicHost)
+}
+
+func TestDefaultFromFieldHelp(t *testing.T) {
+	var args struct {
+		Host       string
+		ListenHost string `default:"$Host"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "[default: same as --host]")
+}
+
+func TestDefaultFromFieldInvalid(t *testing.T) {
+	var args1 struct {
+		A string `default:"$B"`
+		B string `default:"$C"`
+		C string `default:"$A"`
+	}
+	_, err := NewParser(Config{}, &args1)
+	assert.EqualError(t, err, ".A: default refers back to itself through \"B\"\n.B: default refers back to itself through \"C\"\n.C: default refers back to itself through \"A\"")
+
+	// a typo in the name of the field is an error rather than a literal
+	var args2 struct {
+		Host       string
+		ListenHost string `default:"$Hots"`
+	}
+	_, err = NewParser(Config{}, &args2)
+	assert.EqualError(t, err, `.ListenHost: default refers to unknown field "Hots" (write "$$" for a literal "$")`)
+
+	var args3 struct {
+		A string `default:"$B"`
+		B []string
+	}
+	_, err = NewParser(Config{}, &args3)
+	assert.EqualError(t, err, ".A: default refers to \"B\", which is not a single value")
 }
 
 func TestUnexportedFieldsSkipped(t *testing.T) {
@@ -1392,15 +2420,16 @@ func TestUnexportedFieldsSkipped(t *testing.T) {
 
 func TestMustParseInvalidParser(t *testing.T) {
 	originalExit := osExit
-	originalStdout := stdout
+	originalStderr := stderr
 	defer func() {
 		osExit = originalExit
-		stdout = originalStdout
+		stderr = originalStderr
 	}()
 
 	var exitCode int
+	var b bytes.Buffer
 	osExit = func(code int) { exitCode = code }
-	stdout = &bytes.Buffer{}
+	stderr = &b
 
 	var args struct {
 		CannotParse struct{}
@@ -1408,6 +2437,38 @@ func TestMustParseInvalidParser(t *testing.T) {
 	parser := MustParse(&args)
 	assert.Nil(t, parser)
 	assert.Equal(t, -1, exitCode)
+	assert.Equal(t, "error: .CannotParse: struct {} fields are not supported\n", b.String())
+}
+
+func TestMustParseErrorText(t *testing.T) {
+	originalExit := osExit
+	originalStdout := stdout
+	originalStderr := stderr
+	originalArgs := os.Args
+	defer func() {
+		osExit = originalExit
+		stdout = originalStdout
+		stderr = originalStderr
+		os.Args = originalArgs
+	}()
+
+	var exitCode int
+	var out, errOut bytes.Buffer
+	osExit = func(code int) { exitCode = code }
+	stdout = &out
+	stderr = &errOut
+	os.Args = []string{"example", "--optimize", "INVALID"}
+
+	var args struct {
+		Input    string `arg:"positional"`
+		Verbose  bool   `arg:"-v" help:"verbosity level"`
+		Optimize int    `arg:"-O" help:"optimization level"`
+	}
+	MustParse(&args)
+	assert.Equal(t, -1, exitCode)
+	assert.Empty(t, out.String())
+	assert.Equal(t, "Usage: example [--verbose] [--optimize OPTIMIZE] INPUT\n"+
+		"error: error processing --optimize: strconv.ParseInt: parsing \"INVALID\": invalid syntax\n", errOut.String())
 }
 
 func TestMustParsePrintsHelp(t *testing.T) {
@@ -1456,3 +2517,1194 @@ func TestMustParsePrintsVersion(t *testing.T) {
 	assert.Equal(t, 0, *exitCode)
 	assert.Equal(t, "example 3.2.1\n", b.String())
 }
+
+func TestParserMustParse(t *testing.T) {
+	var args struct {
+		Foo int
+	}
+
+	var exitCode *int
+	var out, errOut bytes.Buffer
+	p, err := NewParser(Config{
+		Program: "example",
+		Out:     &out,
+		Err:     &errOut,
+		Exit:    func(code int) { exitCode = &code },
+	}, &args)
+	require.NoError(t, err)
+
+	p.MustParse([]string{"--foo", "3"})
+	assert.Nil(t, exitCode)
+	assert.Equal(t, 3, args.Foo)
+
+	p.MustParse([]string{"--help"})
+	require.NotNil(t, exitCode)
+	assert.Equal(t, 0, *exitCode)
+	assert.Contains(t, out.String(), "Usage: example [--foo FOO]")
+	assert.Empty(t, errOut.String())
+
+	exitCode = nil
+	out.Reset()
+	p.MustParse([]string{"--foo", "x"})
+	require.NotNil(t, exitCode)
+	assert.Equal(t, -1, *exitCode)
+	assert.Empty(t, out.String())
+	assert.Equal(t, "Usage: example [--foo FOO]\nerror: error processing --foo: strconv.ParseInt: parsing \"x\": invalid syntax\n", errOut.String())
+}
+
+func TestParserMustParseNonFatal(t *testing.T) {
+	originalExit := osExit
+	defer func() {
+		osExit = originalExit
+	}()
+	osExit = func(code int) { t.Fatalf("os.Exit(%d) called despite Config.Exit", code) }
+
+	var args versioned
+	var out bytes.Buffer
+	var exits []int
+	p, err := NewParser(Config{
+		Program: "example",
+		Out:     &out,
+		Err:     &out,
+		Exit:    func(code int) { exits = append(exits, code) },
+	}, &args)
+	require.NoError(t, err)
+
+	p.MustParse([]string{"--help"})
+	p.MustParse([]string{"--version"})
+	p.MustParse([]string{"--nope"})
+	assert.Equal(t, []int{0, 0, -1}, exits)
+	assert.Contains(t, out.String(), "Usage: example")
+	assert.Contains(t, out.String(), "example 3.2.1\n")
+}
+
+func TestParserMustParseOutput(t *testing.T) {
+	var args struct {
+		Foo int
+	}
+
+	var output, out, errOut bytes.Buffer
+	p, err := NewParser(Config{
+		Program: "example",
+		Output:  &output,
+		Out:     &out,
+		Err:     &errOut,
+		Exit:    func(int) {},
+	}, &args)
+	require.NoError(t, err)
+
+	p.MustParse([]string{"--help"})
+	p.MustParse([]string{"--foo", "x"})
+	assert.Equal(t, "Usage: example [--foo FOO]\n\nOptions:\n  --foo FOO\n  --help, -h             display this help and exit\n"+
+		"Usage: example [--foo FOO]\nerror: error processing --foo: strconv.ParseInt: parsing \"x\": invalid syntax\n", output.String())
+	assert.Empty(t, out.String())
+	assert.Empty(t, errOut.String())
+}
+
+func TestParseAndExit(t *testing.T) {
+	originalArgs := os.Args
+	defer func() {
+		os.Args = originalArgs
+	}()
+
+	var args struct {
+		Foo int
+	}
+
+	var exitCode *int
+	var out bytes.Buffer
+	p, err := NewParser(Config{
+		Program: "example",
+		Output:  &out,
+		Exit:    func(code int) { exitCode = &code },
+	}, &args)
+	require.NoError(t, err)
+
+	os.Args = []string{"example", "--foo", "3"}
+	p.ParseAndExit()
+	assert.Nil(t, exitCode)
+	assert.Equal(t, 3, args.Foo)
+
+	os.Args = []string{"example", "--help"}
+	p.ParseAndExit()
+	require.NotNil(t, exitCode)
+	assert.Equal(t, 0, *exitCode)
+	assert.Equal(t, "Usage: example [--foo FOO]\n\nOptions:\n  --foo FOO\n  --help, -h             display this help and exit\n", out.String())
+
+	exitCode = nil
+	out.Reset()
+	os.Args = []string{"example", "--foo", "x"}
+	p.ParseAndExit()
+	require.NotNil(t, exitCode)
+	assert.Equal(t, -1, *exitCode)
+	assert.Equal(t, "Usage: example [--foo FOO]\nerror: error processing --foo: strconv.ParseInt: parsing \"x\": invalid syntax\n", out.String())
+}
+
+func TestParseAndExitUsesConfigArgs(t *testing.T) {
+	var args struct {
+		Foo int
+	}
+
+	p, err := NewParser(Config{
+		Args: []string{"--foo", "4"},
+		Exit: func(code int) { t.Fatalf("exit(%d) called", code) },
+	}, &args)
+	require.NoError(t, err)
+
+	p.ParseAndExit()
+	assert.Equal(t, 4, args.Foo)
+}
+
+func TestUnixTime(t *testing.T) {
+	var args struct {
+		Since time.Time  `format:"unix"`
+		Until *time.Time `format:"unixmilli"`
+	}
+	err := parse("--since 1700000000 --until 1700000000123", &args)
+	require.NoError(t, err)
+	assert.True(t, time.Unix(1700000000, 0).Equal(args.Since))
+	require.NotNil(t, args.Until)
+	assert.True(t, time.Unix(1700000000, 123000000).Equal(*args.Until))
+
+	err = parse("--since yesterday", &args)
+	assert.EqualError(t, err, `error processing --since: invalid Unix timestamp "yesterday"`)
+}
+
+func TestUnixTimeDefault(t *testing.T) {
+	var args struct {
+		Since time.Time `format:"unixmilli"`
+	}
+	args.Since = time.Unix(1700000000, 5000000)
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse(nil)
+	require.NoError(t, err)
+	assert.True(t, time.Unix(1700000000, 5000000).Equal(args.Since))
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "[default: 1700000000005]")
+}
+
+func TestUnixTimeInvalid(t *testing.T) {
+	var args1 struct {
+		Since time.Time `format:"epoch"`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, ".Since: format must be unix, unixmilli, or a time layout")
+
+	var args2 struct {
+		Since int64 `format:"unix"`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, ".Since: format is only supported for time.Time fields")
+}
+
+func TestTimeSlice(t *testing.T) {
+	var args struct {
+		At []time.Time
+	}
+	err := parse("--at 2024-01-02T03:04:05Z 2024-06-07T08:09:10+02:00", &args)
+	require.NoError(t, err)
+	require.Len(t, args.At, 2)
+	assert.True(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Equal(args.At[0]))
+	assert.True(t, time.Date(2024, 6, 7, 6, 9, 10, 0, time.UTC).Equal(args.At[1]))
+}
+
+func TestTimeSliceWithLayout(t *testing.T) {
+	var args struct {
+		Days  []time.Time  `arg:"positional" format:"2006-01-02"`
+		Stamp []*time.Time `format:"unix"`
+	}
+	err := parse("2024-01-02 2024-03-04 --stamp 1700000000", &args)
+	require.NoError(t, err)
+	require.Len(t, args.Days, 2)
+	assert.True(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC).Equal(args.Days[0]))
+	assert.True(t, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC).Equal(args.Days[1]))
+	require.Len(t, args.Stamp, 1)
+	assert.True(t, time.Unix(1700000000, 0).Equal(*args.Stamp[0]))
+
+	args.Days = nil
+	err = parse("2024-01-02 tomorrow", &args)
+	assert.EqualError(t, err, `error processing Days: invalid time "tomorrow", expected the form 2006-01-02`)
+}
+
+func TestSliceStopAtKnownFlag(t *testing.T) {
+	var args struct {
+		Files   []string
+		Verbose bool   `arg:"-v"`
+		Output  string `arg:"-o"`
+	}
+	p, err := NewParser(Config{SliceStopAtKnownFlag: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--files", "a.txt", "-b.txt", "-v", "c.txt"})
+	assert.EqualError(t, err, "this command takes no positional arguments, got 'c.txt'")
+
+	args.Files = nil
+	err = p.Parse([]string{"--files", "a.txt", "-b.txt", "--verbose"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "-b.txt"}, args.Files)
+	assert.True(t, args.Verbose)
+
+	args.Files, args.Verbose = nil, false
+	err = p.Parse([]string{"--files", "-x", "-oout.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-x"}, args.Files)
+	assert.Equal(t, "out.txt", args.Output)
+
+	args.Files = nil
+	err = p.Parse([]string{"--files", "-x", "-h"})
+	assert.Equal(t, ErrHelp, err)
+}
+
+func TestSliceStopsAtAnyFlagByDefault(t *testing.T) {
+	var args struct {
+		Files []string
+	}
+	err := parse("--files a.txt -b.txt", &args)
+	assert.EqualError(t, err, "unknown argument -b.txt")
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	args, err := splitCommandLine(` --name 'John Smith'  --title "the \"best\"" a\ b ''`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--name", "John Smith", "--title", `the "best"`, "a b", ""}, args)
+
+	_, err = splitCommandLine(`--name 'John`)
+	assert.EqualError(t, err, "unterminated ' quote")
+
+	_, err = splitCommandLine(`--name John\`)
+	assert.EqualError(t, err, "trailing backslash")
+}
+
+func TestArgsEnv(t *testing.T) {
+	originalArgs := os.Args
+	defer func() {
+		os.Args = originalArgs
+	}()
+
+	var args struct {
+		Name  string
+		Count int
+	}
+	setenv(t, "TEST_ARGS", `--name "John Smith" --count 3`)
+	var out bytes.Buffer
+	p, err := NewParser(Config{
+		ArgsEnv: "TEST_ARGS",
+		Output:  &out,
+		Exit:    func(code int) { t.Fatalf("exit(%d) called: %s", code, out.String()) },
+	}, &args)
+	require.NoError(t, err)
+
+	os.Args = []string{"example"}
+	p.ParseAndExit()
+	assert.Equal(t, "John Smith", args.Name)
+	assert.Equal(t, 3, args.Count)
+
+	// arguments on the command line take precedence over the variable
+	args.Name, args.Count = "", 0
+	os.Args = []string{"example", "--name", "Jane"}
+	p.ParseAndExit()
+	assert.Equal(t, "Jane", args.Name)
+	assert.Equal(t, 0, args.Count)
+}
+
+func TestArgsEnvMalformed(t *testing.T) {
+	originalArgs := os.Args
+	defer func() {
+		os.Args = originalArgs
+	}()
+
+	var args struct {
+		Name string
+	}
+	setenv(t, "TEST_ARGS_MALFORMED", `--name "John`)
+	var exitCode int
+	var out bytes.Buffer
+	p, err := NewParser(Config{
+		Program: "example",
+		ArgsEnv: "TEST_ARGS_MALFORMED",
+		Output:  &out,
+		Exit:    func(code int) { exitCode = code },
+	}, &args)
+	require.NoError(t, err)
+
+	os.Args = []string{"example"}
+	p.ParseAndExit()
+	assert.Equal(t, -1, exitCode)
+	assert.Equal(t, "Usage: example [--name NAME]\nerror: error reading arguments from environment variable TEST_ARGS_MALFORMED: unterminated \" quote\n", out.String())
+}
+
+func TestArgsEnvParse(t *testing.T) {
+	var args struct {
+		Name  string
+		Count int
+	}
+	setenv(t, "TEST_ARGS_PARSE", `--name "John Smith" --count 3`)
+	defer os.Unsetenv("TEST_ARGS_PARSE")
+	p, err := NewParser(Config{ArgsEnv: "TEST_ARGS_PARSE"}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "John Smith", args.Name)
+	assert.Equal(t, 3, args.Count)
+
+	args.Name, args.Count = "", 0
+	err = p.Parse([]string{"--name", "Jane"})
+	require.NoError(t, err)
+	assert.Equal(t, "Jane", args.Name)
+	assert.Equal(t, 0, args.Count)
+
+	setenv(t, "TEST_ARGS_PARSE", `--name "John`)
+	err = p.Parse(nil)
+	assert.EqualError(t, err, "error reading arguments from environment variable TEST_ARGS_PARSE: unterminated \" quote")
+}
+
+func TestArgsEnvMustParse(t *testing.T) {
+	var args struct {
+		Name string
+	}
+	setenv(t, "TEST_ARGS_MUSTPARSE", `--name "John Smith"`)
+	defer os.Unsetenv("TEST_ARGS_MUSTPARSE")
+	var out bytes.Buffer
+	p, err := NewParser(Config{
+		ArgsEnv: "TEST_ARGS_MUSTPARSE",
+		Output:  &out,
+		Exit:    func(code int) { t.Fatalf("exit(%d) called: %s", code, out.String()) },
+	}, &args)
+	require.NoError(t, err)
+
+	p.MustParse(nil)
+	assert.Equal(t, "John Smith", args.Name)
+}
+
+func TestTransform(t *testing.T) {
+	var args struct {
+		Region string   `transform:"lower"`
+		Code   *string  `transform:"upper"`
+		Name   string   `transform:"trim"`
+		Tags   []string `transform:"trim,lower"`
+		Mode   string   `transform:"lower" choices:"fast,slow"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"--region", "US-East", "--code", "abc", "--name", " x ", "--tags", " A ", "B", "--mode", "FAST"})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east", args.Region)
+	require.NotNil(t, args.Code)
+	assert.Equal(t, "ABC", *args.Code)
+	assert.Equal(t, "x", args.Name)
+	assert.Equal(t, []string{"a", "b"}, args.Tags)
+	assert.Equal(t, "fast", args.Mode)
+}
+
+func TestTransformInvalid(t *testing.T) {
+	var args1 struct {
+		Name string `transform:"title"`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, ".Name: unrecognized transform 'title'")
+
+	var args2 struct {
+		Count int `transform:"trim"`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, ".Count: transform is only supported for string fields")
+}
+
+func TestSliceUntilSentinel(t *testing.T) {
+	var args struct {
+		Include []string `until:""`
+		Exclude []string `until:"END"`
+		Verbose bool
+		Rest    []string `arg:"positional"`
+	}
+	err := parse("--include a -b --verbose -- --exclude x -y END c d", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "-b", "--verbose"}, args.Include)
+	assert.Equal(t, []string{"x", "-y"}, args.Exclude)
+	assert.False(t, args.Verbose)
+	assert.Equal(t, []string{"c", "d"}, args.Rest)
+}
+
+func TestSliceUntilMissingSentinel(t *testing.T) {
+	var args struct {
+		Include []string `until:"END"`
+	}
+	err := parse("--include a --b", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "--b"}, args.Include)
+}
+
+func TestSliceUntilInvalid(t *testing.T) {
+	var args struct {
+		Name string `until:"END"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".Name: until is only supported for slice and map options that are not positional or separate")
+}
+
+// trimmed is a string that removes surrounding whitespace from itself
+type trimmed string
+
+func (s *trimmed) Normalize() {
+	*s = trimmed(strings.TrimSpace(string(*s)))
+}
+
+func TestNormalize(t *testing.T) {
+	var args struct {
+		Name    trimmed
+		Names   []trimmed
+		Ptr     *trimmed
+		Default trimmed `default:"  x  "`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"--name", "  bob  ", "--names", " a", "b ", "--ptr", " c "})
+	require.NoError(t, err)
+	assert.Equal(t, trimmed("bob"), args.Name)
+	assert.Equal(t, []trimmed{"a", "b"}, args.Names)
+	assert.Equal(t, trimmed("c"), *args.Ptr)
+	assert.Equal(t, trimmed("x"), args.Default)
+}
+
+func TestNormalizeBeforeValidation(t *testing.T) {
+	var args struct {
+		Mode trimmed
+		Cert string `requiredif:"Mode=ssl"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"--mode", " ssl "})
+	assert.EqualError(t, err, "--cert is required when --mode is ssl")
+}
+
+func TestBaseOctal(t *testing.T) {
+	var args struct {
+		Mode  os.FileMode `arg:"-m" base:"8"`
+		Umask *uint32     `base:"8" default:"022"`
+	}
+	err := parse("-m 755", &args)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(493), args.Mode)
+	require.NotNil(t, args.Umask)
+	assert.Equal(t, uint32(18), *args.Umask)
+}
+
+func TestBaseHex(t *testing.T) {
+	var args struct {
+		Color  int  `base:"16"`
+		Offset int8 `base:"16"`
+	}
+	err := parse("--color ff8800 --offset -7f", &args)
+	require.NoError(t, err)
+	assert.Equal(t, 0xff8800, args.Color)
+	assert.Equal(t, int8(-0x7f), args.Offset)
+}
+
+func TestBaseInvalidDigit(t *testing.T) {
+	var args struct {
+		Mode uint32 `base:"8"`
+	}
+	err := parse("--mode 789", &args)
+	assert.EqualError(t, err, `error processing --mode: strconv.ParseUint: parsing "789": invalid syntax`)
+}
+
+func TestBaseInvalid(t *testing.T) {
+	var args struct {
+		Mode uint32 `base:"7"`
+	}
+	_, err := NewParser(Config{}, &args)
+	assert.EqualError(t, err, ".Mode: base must be 2, 8, 10, or 16")
+
+	var args2 struct {
+		Name string `base:"8"`
+	}
+	_, err = NewParser(Config{}, &args2)
+	assert.EqualError(t, err, ".Name: base is only supported for integer fields")
+}
+
+func TestLenientDashes(t *testing.T) {
+	var args struct {
+		Verbose bool
+		Name    string `arg:"-n"`
+	}
+	err := parse("-verbose --n foo", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Verbose)
+	assert.Equal(t, "foo", args.Name)
+}
+
+func TestStrictDashes(t *testing.T) {
+	var args struct {
+		Verbose bool
+		Name    string `arg:"-n"`
+	}
+	p, err := NewParser(Config{StrictDashes: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--verbose", "-n", "foo"})
+	require.NoError(t, err)
+	assert.True(t, args.Verbose)
+	assert.Equal(t, "foo", args.Name)
+
+	err = p.Parse([]string{"-verbose"})
+	assert.EqualError(t, err, "unknown argument -verbose")
+
+	err = p.Parse([]string{"--n", "foo"})
+	assert.EqualError(t, err, "unknown argument --n")
+
+	err = p.Parse([]string{"---verbose"})
+	assert.EqualError(t, err, "unknown argument ---verbose")
+}
+
+func TestPreProcess(t *testing.T) {
+	var args struct {
+		Verbose bool
+		Format  string
+		Files   []string `arg:"positional"`
+	}
+	expandAliases := func(in []string) []string {
+		var out []string
+		for _, arg := range in {
+			if arg == "--debug" {
+				out = append(out, "--verbose", "--format=json")
+				continue
+			}
+			out = append(out, arg)
+		}
+		return out
+	}
+	p, err := NewParser(Config{PreProcess: expandAliases}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"a", "--debug", "b"})
+	require.NoError(t, err)
+	assert.True(t, args.Verbose)
+	assert.Equal(t, "json", args.Format)
+	assert.Equal(t, []string{"a", "b"}, args.Files)
+}
+
+func TestConfigArgs(t *testing.T) {
+	var args struct {
+		Foo  string
+		Bars []string `arg:"positional"`
+	}
+	p, err := NewParser(Config{Args: []string{"--foo", "x", "a", "b"}}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "x", args.Foo)
+	assert.Equal(t, []string{"a", "b"}, args.Bars)
+
+	// explicit arguments take precedence over Config.Args
+	err = p.Parse([]string{"--foo", "y"})
+	require.NoError(t, err)
+	assert.Equal(t, "y", args.Foo)
+}
+
+func TestStdin(t *testing.T) {
+	var args struct {
+		Message string `arg:"-m,stdin"`
+		Data    []byte `arg:"stdin"`
+		Input   string `arg:"positional,stdin"`
+	}
+	p, err := NewParser(Config{In: strings.NewReader("from stdin")}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"-m", "-", "--data", "abc", "x"})
+	require.NoError(t, err)
+	assert.Equal(t, "from stdin", args.Message)
+	assert.Equal(t, []byte("abc"), args.Data)
+	assert.Equal(t, "x", args.Input)
+}
+
+func TestStdinBytesPositional(t *testing.T) {
+	var args struct {
+		Input []byte `arg:"positional,stdin"`
+	}
+	p, err := NewParser(Config{In: strings.NewReader("line 1\nline 2\n")}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"-"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("line 1\nline 2\n"), args.Input)
+}
+
+func TestStdinUnsupportedType(t *testing.T) {
+	var args struct {
+		Count int `arg:"stdin"`
+	}
+	_, err := NewParser(Config{}, &args)
+	assert.EqualError(t, err, ".Count: stdin is only supported for string and []byte fields")
+}
+
+func TestMaxPositionals(t *testing.T) {
+	var args struct {
+		Files []string `arg:"positional"`
+	}
+	p, err := NewParser(Config{MaxPositionals: 3}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"a", "b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, args.Files)
+
+	err = p.Parse([]string{"a", "b", "c", "d"})
+	assert.EqualError(t, err, "too many positional arguments at 'd' (at most 3 allowed)")
+}
+
+func TestMaxPositionalsUnlimited(t *testing.T) {
+	var args struct {
+		Files []string `arg:"positional"`
+	}
+	err := parse("a b c d e f", &args)
+	require.NoError(t, err)
+	assert.Len(t, args.Files, 6)
+}
+
+func TestJSONMap(t *testing.T) {
+	var args struct {
+		Labels map[string]int `arg:"json"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"--labels", `{"a": 1, "b": 2}`})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, args.Labels)
+}
+
+func TestJSONStruct(t *testing.T) {
+	type server struct {
+		Host string   `json:"host"`
+		Port int      `json:"port"`
+		Tags []string `json:"tags"`
+	}
+	var args struct {
+		Config *server `arg:"--config,json"`
+		Backup server  `arg:"json" default:"{\"host\": \"backup\"}"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"--config", `{"host": "example.com", "port": 8080, "tags": ["a"]}`})
+	require.NoError(t, err)
+	require.NotNil(t, args.Config)
+	assert.Equal(t, server{Host: "example.com", Port: 8080, Tags: []string{"a"}}, *args.Config)
+	assert.Equal(t, server{Host: "backup"}, args.Backup)
+}
+
+func TestJSONMalformed(t *testing.T) {
+	var args struct {
+		Config map[string]string `arg:"json"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse([]string{"--config", `{"a": `})
+	assert.EqualError(t, err, "error processing --config: invalid JSON: unexpected end of JSON input")
+}
+
+func TestJSONInitialValue(t *testing.T) {
+	args := struct {
+		Labels map[string]int `arg:"json"`
+	}{
+		Labels: map[string]int{"a": 1},
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	err = p.Parse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1}, args.Labels)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), `--labels LABELS [default: {"a":1}]`)
+}
+
+func TestErrorsWrapUnderlyingError(t *testing.T) {
+	var args struct {
+		Foo   int
+		Bars  []int
+		Input int `arg:"positional"`
+	}
+	var numErr *strconv.NumError
+
+	err := parse("--foo x", &args)
+	require.True(t, errors.As(err, &numErr))
+	assert.Equal(t, "x", numErr.Num)
+	assert.Equal(t, strconv.ErrSyntax, numErr.Err)
+	assert.EqualError(t, err, `error processing --foo: strconv.ParseInt: parsing "x": invalid syntax`)
+
+	err = parse("--bars 1 y", &args)
+	require.True(t, errors.As(err, &numErr))
+	assert.Equal(t, "y", numErr.Num)
+
+	err = parse("z", &args)
+	require.True(t, errors.As(err, &numErr))
+	assert.Equal(t, "z", numErr.Num)
+}
+
+func TestInvert(t *testing.T) {
+	var args struct {
+		Color bool  `arg:"--no-color,invert" default:"true"`
+		Cache *bool `arg:"invert"`
+	}
+
+	err := parse("", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Color)
+	assert.Nil(t, args.Cache)
+
+	err = parse("--no-color --cache", &args)
+	require.NoError(t, err)
+	assert.False(t, args.Color)
+	require.NotNil(t, args.Cache)
+	assert.False(t, *args.Cache)
+}
+
+func TestInvertExplicitValue(t *testing.T) {
+	var args struct {
+		Color bool `arg:"--no-color,invert"`
+	}
+
+	err := parse("--no-color=true", &args)
+	require.NoError(t, err)
+	assert.False(t, args.Color)
+
+	err = parse("--no-color=false", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Color)
+
+	err = parse("--no-color=maybe", &args)
+	assert.Error(t, err)
+}
+
+func TestInvertEnv(t *testing.T) {
+	var args struct {
+		Color bool `arg:"--no-color,invert,env:NO_COLOR"`
+	}
+	_, err := parseWithEnv("", []string{"NO_COLOR=1"}, &args)
+	os.Unsetenv("NO_COLOR")
+	require.NoError(t, err)
+	assert.False(t, args.Color)
+}
+
+func TestInvertOnlyBool(t *testing.T) {
+	var args struct {
+		Name string `arg:"invert"`
+	}
+	_, err := NewParser(Config{}, &args)
+	assert.EqualError(t, err, ".Name: invert is only supported for boolean fields")
+}
+
+func TestLongValueSeparators(t *testing.T) {
+	var args struct {
+		Foo string
+		Bar string
+		Baz string `arg:"-z"`
+	}
+	p, err := NewParser(Config{LongValueSeparators: []string{":"}}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--foo:x", "--bar", "y", "-z=w"})
+	require.NoError(t, err)
+	assert.Equal(t, "x", args.Foo)
+	assert.Equal(t, "y", args.Bar)
+	assert.Equal(t, "w", args.Baz)
+
+	err = p.Parse([]string{"--foo=x"})
+	assert.EqualError(t, err, "unknown argument --foo=x")
+}
+
+func TestMixedLongValueSeparators(t *testing.T) {
+	var args struct {
+		Foo string
+		Bar string
+	}
+	p, err := NewParser(Config{LongValueSeparators: []string{"=", ":"}}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--foo:a=b", "--bar=c:d"})
+	require.NoError(t, err)
+	assert.Equal(t, "a=b", args.Foo)
+	assert.Equal(t, "c:d", args.Bar)
+}
+
+func TestSeparateMapKeysWithoutValues(t *testing.T) {
+	var args struct {
+		Defines map[string]string `arg:"-D,separate"`
+	}
+	err := parse("-D DEBUG -D VERSION=1.2 -D EMPTY= -D URL=a=b", &args)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"DEBUG":   "",
+		"VERSION": "1.2",
+		"EMPTY":   "",
+		"URL":     "a=b",
+	}, args.Defines)
+}
+
+func TestMapKeyWithoutValueRequiresSeparate(t *testing.T) {
+	var args struct {
+		Defines map[string]string `arg:"-D"`
+	}
+	err := parse("-D DEBUG", &args)
+	assert.EqualError(t, err, `error processing -D: cannot parse "DEBUG" into a map, expected format key=value`)
+}
+
+func TestDecimalSeparator(t *testing.T) {
+	var args struct {
+		Ratio  float64
+		Scale  *float32
+		Points []float64
+		Name   string
+	}
+	p, err := NewParser(Config{DecimalSeparator: ','}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--ratio", "3,14", "--scale", "0,5", "--points", "1,5", "2", "--name", "a,b"})
+	require.NoError(t, err)
+	assert.Equal(t, 3.14, args.Ratio)
+	assert.Equal(t, float32(0.5), *args.Scale)
+	assert.Equal(t, []float64{1.5, 2}, args.Points)
+	assert.Equal(t, "a,b", args.Name)
+}
+
+func TestDecimalSeparatorNotSet(t *testing.T) {
+	var args struct {
+		Ratio float64
+	}
+	err := parse("--ratio 3,14", &args)
+	assert.EqualError(t, err, `error processing --ratio: strconv.ParseFloat: parsing "3,14": invalid syntax`)
+}
+
+func TestExpandEnv(t *testing.T) {
+	var args struct {
+		Path  string
+		Files []string `arg:"positional"`
+		Rest  []string `arg:"passthrough"`
+	}
+	setenv(t, "EXPAND_TEST_DIR", "/home/test")
+	p, err := NewParser(Config{ExpandEnv: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--path", "${EXPAND_TEST_DIR}/data", "$EXPAND_TEST_DIR/a", "${EXPAND_TEST_UNSET}b", "--", "$EXPAND_TEST_DIR"})
+	require.NoError(t, err)
+	assert.Equal(t, "/home/test/data", args.Path)
+	assert.Equal(t, []string{"/home/test/a", "b"}, args.Files)
+	assert.Equal(t, []string{"$EXPAND_TEST_DIR"}, args.Rest)
+}
+
+func TestExpandEnvDisabled(t *testing.T) {
+	var args struct {
+		Path string
+	}
+	setenv(t, "EXPAND_TEST_DIR", "/home/test")
+	err := parse("--path ${EXPAND_TEST_DIR}/data", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "${EXPAND_TEST_DIR}/data", args.Path)
+}
+
+func TestClone(t *testing.T) {
+	type argsType struct {
+		Name  string
+		Count int    `default:"1"`
+		File  string `arg:"positional"`
+		Get   *struct {
+			ID int `arg:"positional"`
+		} `arg:"subcommand"`
+	}
+	var base argsType
+	p, err := NewParser(Config{}, &base)
+	require.NoError(t, err)
+
+	cmdlines := [][]string{
+		{"--name", "a", "x"},
+		{"--name", "b", "--count", "5", "z", "get", "7"},
+	}
+	results := make([]argsType, len(cmdlines))
+	errs := make([]error, len(cmdlines))
+
+	var wg sync.WaitGroup
+	for i := range cmdlines {
+		clone, err := p.Clone(&results[i])
+		require.NoError(t, err)
+		wg.Add(1)
+		go func(i int, clone *Parser) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				results[i] = argsType{}
+				errs[i] = clone.Parse(cmdlines[i])
+			}
+		}(i, clone)
+	}
+	wg.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	assert.Equal(t, "a", results[0].Name)
+	assert.Equal(t, 1, results[0].Count)
+	assert.Equal(t, "x", results[0].File)
+	assert.Nil(t, results[0].Get)
+	assert.Equal(t, "b", results[1].Name)
+	assert.Equal(t, 5, results[1].Count)
+	require.NotNil(t, results[1].Get)
+	assert.Equal(t, 7, results[1].Get.ID)
+	assert.Equal(t, argsType{}, base)
+}
+
+func TestCloneWrongDestination(t *testing.T) {
+	var args struct {
+		Name string
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	_, err = p.Clone()
+	assert.EqualError(t, err, "expected 1 destinations but got 0")
+
+	var other struct {
+		Other int
+	}
+	_, err = p.Clone(&other)
+	assert.Error(t, err)
+}
+
+func TestUnique(t *testing.T) {
+	var args struct {
+		Files []string `arg:"positional,unique"`
+		Ports []int    `arg:"-p,separate,unique"`
+	}
+
+	err := parse("a b c -p 1 -p 2", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, args.Files)
+	assert.Equal(t, []int{1, 2}, args.Ports)
+
+	err = parse("a b a", &args)
+	assert.EqualError(t, err, `error processing Files: duplicate value "a"`)
+
+	err = parse("-p 1 -p 01", &args)
+	assert.EqualError(t, err, `error processing -p: duplicate value "1"`)
+}
+
+func TestUniqueOnlySlices(t *testing.T) {
+	var args struct {
+		Name string `arg:"unique"`
+	}
+	_, err := NewParser(Config{}, &args)
+	assert.EqualError(t, err, ".Name: unique is only supported for slice fields")
+}
+
+func TestExplicitBool(t *testing.T) {
+	var args struct {
+		Enabled bool `arg:"explicitbool"`
+		Verbose bool
+	}
+
+	err := parse("--enabled=true --verbose", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Enabled)
+	assert.True(t, args.Verbose)
+
+	err = parse("--enabled=false", &args)
+	require.NoError(t, err)
+	assert.False(t, args.Enabled)
+
+	err = parse("--enabled", &args)
+	assert.EqualError(t, err, "--enabled requires a value")
+}
+
+func TestExplicitBoolOnlyBool(t *testing.T) {
+	var args struct {
+		Name string `arg:"explicitbool"`
+	}
+	_, err := NewParser(Config{}, &args)
+	assert.EqualError(t, err, ".Name: explicitbool is only supported for boolean fields")
+}
+
+// level implements flag.Value for a named verbosity level
+type level int
+
+func (l *level) String() string {
+	return [...]string{"quiet", "normal", "loud"}[*l]
+}
+
+func (l *level) Set(s string) error {
+	switch s {
+	case "quiet":
+		*l = 0
+	case "normal":
+		*l = 1
+	case "loud":
+		*l = 2
+	default:
+		return fmt.Errorf("unknown level %q", s)
+	}
+	return nil
+}
+
+// listFlag implements flag.Value by appending each value it is given
+type listFlag struct {
+	items []string
+}
+
+func (f *listFlag) String() string     { return strings.Join(f.items, ",") }
+func (f *listFlag) Set(s string) error { f.items = append(f.items, s); return nil }
+
+// switchFlag implements flag.Value as a boolean flag
+type switchFlag struct {
+	on bool
+}
+
+func (f *switchFlag) String() string   { return strconv.FormatBool(f.on) }
+func (f *switchFlag) IsBoolFlag() bool { return true }
+func (f *switchFlag) Set(s string) error {
+	var err error
+	f.on, err = strconv.ParseBool(s)
+	return err
+}
+
+func TestFlagValue(t *testing.T) {
+	var args struct {
+		Level  level
+		Levels []level
+		Ptr    *level
+		List   listFlag
+		Switch switchFlag
+	}
+	err := parse("--level loud --levels quiet normal --ptr normal --list a --switch", &args)
+	require.NoError(t, err)
+	assert.Equal(t, level(2), args.Level)
+	assert.Equal(t, []level{0, 1}, args.Levels)
+	require.NotNil(t, args.Ptr)
+	assert.Equal(t, level(1), *args.Ptr)
+	assert.Equal(t, []string{"a"}, args.List.items)
+	assert.True(t, args.Switch.on)
+
+	err = parse("--level deafening", &args)
+	assert.EqualError(t, err, `error processing --level: unknown level "deafening"`)
+}
+
+func TestFlagValueDefault(t *testing.T) {
+	args := struct {
+		Level level
+	}{
+		Level: 2,
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "--level LEVEL [default: loud]")
+
+	err = p.Parse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, level(2), args.Level)
+}
+
+func TestShortOptionAttachedValue(t *testing.T) {
+	var args struct {
+		Expr    string   `arg:"-e"`
+		Level   int      `arg:"-O"`
+		Include []string `arg:"-I,separate"`
+		Verbose bool     `arg:"-v"`
+	}
+
+	err := parse("-eEXPR -O2 -I/usr/include -I /opt/include -v", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "EXPR", args.Expr)
+	assert.Equal(t, 2, args.Level)
+	assert.Equal(t, []string{"/usr/include", "/opt/include"}, args.Include)
+	assert.True(t, args.Verbose)
+
+	args.Include = nil
+	err = parse("-e EXPR", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "EXPR", args.Expr)
+
+	err = parse("-ea=b", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "a=b", args.Expr)
+
+	err = parse("-e=x", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "x", args.Expr)
+
+	err = parse("-vx", &args)
+	assert.EqualError(t, err, "unknown argument -vx")
+}
+
+func TestDisableClustering(t *testing.T) {
+	var args struct {
+		Out     string `arg:"-o"`
+		Verbose bool   `arg:"--verbose"`
+	}
+	p, err := NewParser(Config{DisableClustering: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"-o", "out.txt", "-verbose"})
+	require.NoError(t, err)
+	assert.Equal(t, "out.txt", args.Out)
+	assert.True(t, args.Verbose)
+
+	err = p.Parse([]string{"-output"})
+	assert.EqualError(t, err, "unknown argument -output")
+
+	err = parse("-output", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "utput", args.Out)
+}
+
+// defined types over the basic kinds, without any methods
+type (
+	namedString string
+	namedBool   bool
+	namedInt    int
+	namedFloat  float64
+)
+
+func TestNamedTypes(t *testing.T) {
+	var args struct {
+		Level    namedString
+		Flag     namedBool
+		Count    namedInt
+		Ratio    namedFloat
+		Optional *namedString
+		Levels   []namedString
+		Quiet    namedBool   `arg:"--loud,invert"`
+		Mode     namedInt    `base:"8"`
+		Color    namedString `arg:"positional" choices:"red,green" transform:"lower"`
+	}
+	err := parse("--level debug --flag --count 3 --ratio 0.5 --optional x --levels a b --loud --mode 755 RED", &args)
+	require.NoError(t, err)
+	assert.Equal(t, namedString("debug"), args.Level)
+	assert.Equal(t, namedBool(true), args.Flag)
+	assert.Equal(t, namedInt(3), args.Count)
+	assert.Equal(t, namedFloat(0.5), args.Ratio)
+	require.NotNil(t, args.Optional)
+	assert.Equal(t, namedString("x"), *args.Optional)
+	assert.Equal(t, []namedString{"a", "b"}, args.Levels)
+	assert.Equal(t, namedBool(false), args.Quiet)
+	assert.Equal(t, namedInt(493), args.Mode)
+	assert.Equal(t, namedString("red"), args.Color)
+}
+
+func TestNamedTypesDefaultsAndEnv(t *testing.T) {
+	var args struct {
+		Level namedString `arg:"env" default:"info"`
+		Flag  namedBool   `arg:"env"`
+		Count namedInt    `default:"$Limit"`
+		Limit namedInt    `default:"7"`
+	}
+	setenv(t, "FLAG", "yes")
+	defer os.Unsetenv("FLAG")
+	err := parse("", &args)
+	require.NoError(t, err)
+	assert.Equal(t, namedString("info"), args.Level)
+	assert.Equal(t, namedBool(true), args.Flag)
+	assert.Equal(t, namedInt(7), args.Count)
+}
@@ -0,0 +1,36 @@
+package arg
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// prompt reads the value of each option marked with "prompt" that has not
+// been given from the terminal
+func (p *Parser) prompt(specs []*spec, wasPresent map[*spec]bool) error {
+	for _, spec := range specs {
+		if !spec.prompt || wasPresent[spec] {
+			continue
+		}
+		f, ok := p.in().(*os.File)
+		if !ok || !term.IsTerminal(int(f.Fd())) {
+			return fmt.Errorf("%s was not given and cannot be prompted for because standard input is not a terminal", spec.name())
+		}
+
+		fmt.Fprintf(p.err(), "%s: ", spec.field.Name)
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(p.err())
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", spec.name(), err)
+		}
+		value := string(password)
+		if err := p.setValue(spec, value); err != nil {
+			return fmt.Errorf("error processing %s: %w", spec.name(), redact(spec, err, value))
+		}
+		wasPresent[spec] = true
+		p.sources[spec] = SourcePrompt
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package arg
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromptNotTerminal(t *testing.T) {
+	var args struct {
+		Password string `arg:"required,sensitive,prompt"`
+	}
+	p, err := NewParser(Config{AllowPrompt: true, In: strings.NewReader("secret\n")}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse(nil)
+	assert.EqualError(t, err, "--password was not given and cannot be prompted for because standard input is not a terminal")
+	assert.Equal(t, "", args.Password)
+}
+
+func TestPromptCharDeviceNotTerminal(t *testing.T) {
+	// the null device is a character device but not a terminal
+	devNull, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	defer devNull.Close()
+
+	var args struct {
+		Password string `arg:"required,sensitive,prompt"`
+	}
+	var stderr bytes.Buffer
+	p, err := NewParser(Config{AllowPrompt: true, In: devNull, Err: &stderr}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse(nil)
+	assert.EqualError(t, err, "--password was not given and cannot be prompted for because standard input is not a terminal")
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestPromptNotNeeded(t *testing.T) {
+	var args struct {
+		Password string `arg:"env,sensitive,prompt"`
+	}
+	p, err := NewParser(Config{AllowPrompt: true, In: strings.NewReader("")}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--password", "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "secret", args.Password)
+
+	setenv(t, "PASSWORD", "fromenv")
+	defer os.Unsetenv("PASSWORD")
+	err = p.Parse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "fromenv", args.Password)
+	assert.Equal(t, SourceEnv, p.Source("password"))
+}
+
+func TestPromptNotAllowed(t *testing.T) {
+	var args struct {
+		Password string `arg:"required,sensitive,prompt"`
+	}
+	p, err := NewParser(Config{In: strings.NewReader("")}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse(nil)
+	assert.EqualError(t, err, "--password is required")
+}
+
+func TestPromptInvalid(t *testing.T) {
+	var args1 struct {
+		Password string `arg:"prompt"`
+	}
+	_, err := NewParser(Config{}, &args1)
+	assert.EqualError(t, err, ".Password: prompt is only supported for sensitive fields with a single value")
+
+	var args2 struct {
+		Keys []string `arg:"sensitive,prompt"`
+	}
+	_, err = NewParser(Config{}, &args2)
+	assert.EqualError(t, err, ".Keys: prompt is only supported for sensitive fields with a single value")
+}
@@ -2,8 +2,11 @@ package arg
 
 import (
 	"encoding"
+	"flag"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -12,6 +15,12 @@ import (
 
 var textUnmarshalerType = reflect.TypeOf([]encoding.TextUnmarshaler{}).Elem()
 
+// flagValueType is the reflected form of flag.Value
+var flagValueType = reflect.TypeOf([]flag.Value{}).Elem()
+
+// nestedMapType is the type of maps that are populated from dotted key paths
+var nestedMapType = reflect.TypeOf(map[string]interface{}{})
+
 // cardinality tracks how many tokens are expected for a given spec
 //  - zero is a boolean, which does to expect any value
 //  - one is an ordinary option that will be parsed from a single token
@@ -42,7 +51,7 @@ func (k cardinality) String() string {
 
 // cardinalityOf returns true if the type can be parsed from a string
 func cardinalityOf(t reflect.Type) (cardinality, error) {
-	if scalar.CanParse(t) {
+	if canParse(t) {
 		if isBoolean(t) {
 			return zero, nil
 		}
@@ -57,15 +66,24 @@ func cardinalityOf(t reflect.Type) (cardinality, error) {
 	// look inside slice and map types
 	switch t.Kind() {
 	case reflect.Slice:
-		if !scalar.CanParse(t.Elem()) {
+		if isTuple(t.Elem()) {
+			return multiple, nil
+		}
+		if !canParse(t.Elem()) {
 			return unsupported, fmt.Errorf("cannot parse into %v because %v not supported", t, t.Elem())
 		}
 		return multiple, nil
 	case reflect.Map:
-		if !scalar.CanParse(t.Key()) {
+		if t == nestedMapType {
+			return multiple, nil
+		}
+		if !canParse(t.Key()) {
 			return unsupported, fmt.Errorf("cannot parse into %v because key type %v not supported", t, t.Elem())
 		}
-		if !scalar.CanParse(t.Elem()) {
+		if isMultimap(t) {
+			return multiple, nil
+		}
+		if !canParse(t.Elem()) {
 			return unsupported, fmt.Errorf("cannot parse into %v because value type %v not supported", t, t.Elem())
 		}
 		return multiple, nil
@@ -74,11 +92,52 @@ func cardinalityOf(t reflect.Type) (cardinality, error) {
 	}
 }
 
+// isMultimap returns true if the type is a map whose values are slices, such
+// as url.Values, which collects every value given for each key
+func isMultimap(t reflect.Type) bool {
+	if t.Kind() != reflect.Map {
+		return false
+	}
+	val := t.Elem()
+	return val.Kind() == reflect.Slice && !canParse(val) && canParse(val.Elem())
+}
+
+// canParse returns true if the type can be parsed from a single string
+func canParse(t reflect.Type) bool {
+	return scalar.CanParse(t) || isFlagValue(t)
+}
+
+// isFlagValue returns true if the type, or a pointer to it, implements
+// flag.Value and is not parsed with a TextUnmarshaler
+func isFlagValue(t reflect.Type) bool {
+	if t.Implements(textUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return false
+	}
+	return t.Implements(flagValueType) || reflect.PtrTo(t).Implements(flagValueType)
+}
+
+// isBoolFlag returns true if the type is a flag.Value that reports itself
+// as a boolean flag
+func isBoolFlag(t reflect.Type) bool {
+	if !isFlagValue(t) {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if b, ok := reflect.New(t).Interface().(interface{ IsBoolFlag() bool }); ok {
+		return b.IsBoolFlag()
+	}
+	return false
+}
+
 // isBoolean returns true if the type can be parsed from a single string
 func isBoolean(t reflect.Type) bool {
 	switch {
 	case t.Implements(textUnmarshalerType):
 		return false
+	case isFlagValue(t):
+		return isBoolFlag(t)
 	case t.Kind() == reflect.Bool:
 		return true
 	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Bool:
@@ -88,6 +147,67 @@ func isBoolean(t reflect.Type) bool {
 	}
 }
 
+// isInteger returns true if the type, or the type it points to, is a signed
+// or unsigned integer that is not parsed with a TextUnmarshaler
+func isInteger(t reflect.Type) bool {
+	if t.Implements(textUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// elemKind returns the kind of the values held by a field, looking through
+// pointers and slices, so that it is reflect.String for string, *string,
+// []string, and []*string
+func elemKind(t reflect.Type) reflect.Kind {
+	t = sliceElem(t)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind()
+}
+
+// timeType is the reflected form of time.Time
+var timeType = reflect.TypeOf(time.Time{})
+
+// isTime returns true if the type is time.Time or a pointer to it
+func isTime(t reflect.Type) bool {
+	return t == timeType || (t.Kind() == reflect.Ptr && t.Elem() == timeType)
+}
+
+// isTuple returns true if the type is a struct that is filled from a group of
+// consecutive tokens, one for each of its fields
+func isTuple(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || scalar.CanParse(t) || t.NumField() == 0 {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !isExported(field.Name) || !scalar.CanParse(field.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// tuplePlaceholder returns the names of the fields of a tuple struct in upper
+// case, separated by spaces
+func tuplePlaceholder(t reflect.Type) string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, strings.ToUpper(t.Field(i).Name))
+	}
+	return strings.Join(names, " ")
+}
+
 // isExported returns true if the struct field name is exported
 func isExported(field string) bool {
 	r, _ := utf8.DecodeRuneInString(field) // returns RuneError for empty string or invalid UTF8
@@ -101,7 +221,7 @@ func isZero(v reflect.Value) bool {
 		return v.IsNil()
 	}
 	if !t.Comparable() {
-		return false
+		return reflect.DeepEqual(v.Interface(), reflect.Zero(t).Interface())
 	}
 	return v.Interface() == reflect.Zero(t).Interface()
 }
@@ -0,0 +1,344 @@
+package arg
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	scalar "github.com/alexflint/go-scalar"
+)
+
+// setScalar parses s into v. Parsing is delegated to go-scalar, except that
+// booleans additionally accept "yes", "no", "on", and "off" in any case.
+func setScalar(v reflect.Value, s string) error {
+	t := v.Type()
+	if isBoolean(t) && !reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		switch strings.ToLower(s) {
+		case "yes", "on":
+			s = "true"
+		case "no", "off":
+			s = "false"
+		}
+	}
+	if isFlagValue(t) {
+		return setFlagValue(v, s)
+	}
+	return scalar.ParseValue(v, s)
+}
+
+// setFlagValue parses s into v, which implements flag.Value either directly
+// or through a pointer
+func setFlagValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	return flagValueOf(v).Set(s)
+}
+
+// flagValueOf returns v, or a pointer to it, as a flag.Value
+func flagValueOf(v reflect.Value) flag.Value {
+	if fv, ok := v.Interface().(flag.Value); ok {
+		return fv
+	}
+	return v.Addr().Interface().(flag.Value)
+}
+
+// setValue parses s into the field for a single-valued option
+func (p *Parser) setValue(spec *spec, s string) error {
+	s, err := spec.choose(spec.transform(s))
+	if err != nil {
+		return err
+	}
+	v := p.val(spec.dest)
+	switch {
+	case spec.stdin:
+		err = p.setFromStdin(v, s)
+	case spec.json:
+		err = setJSON(v, s)
+	case spec.base != 0:
+		err = setInteger(v, s, spec.base)
+	case spec.format != "":
+		err = setTime(v, s, spec.format)
+	default:
+		err = setScalar(v, p.localize(spec, s))
+	}
+	if err != nil {
+		return err
+	}
+	normalize(v)
+	return nil
+}
+
+// bytesType is the reflected form of []byte
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// isStdinType returns true if the type can hold a value read from standard
+// input
+func isStdinType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.String || t == bytesType
+}
+
+// in returns the reader for fields marked with "stdin"
+func (p *Parser) in() io.Reader {
+	if p.config.In != nil {
+		return p.config.In
+	}
+	return os.Stdin
+}
+
+// setFromStdin sets v, which must be a string or []byte, to s, or to the
+// whole of standard input if s is "-"
+func (p *Parser) setFromStdin(v reflect.Value, s string) error {
+	if s == "-" {
+		b, err := ioutil.ReadAll(p.in())
+		if err != nil {
+			return err
+		}
+		s = string(b)
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Type() == bytesType {
+		v.SetBytes([]byte(s))
+		return nil
+	}
+	v.SetString(s)
+	return nil
+}
+
+// setJSON decodes the JSON document s into v
+func setJSON(v reflect.Value, s string) error {
+	if err := json.Unmarshal([]byte(s), v.Addr().Interface()); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return nil
+}
+
+// setInteger parses s into v, which must be an integer or a pointer to one,
+// using the given base
+func setInteger(v reflect.Value, s string, base int) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := strconv.ParseUint(s, base, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(x)
+	default:
+		x, err := strconv.ParseInt(s, base, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(x)
+	}
+	return nil
+}
+
+// setTime parses s into v, which must be a time.Time or a pointer to one, as
+// a number of seconds ("unix") or milliseconds ("unixmilli") since the epoch,
+// or otherwise according to format as a layout for time.Parse
+func setTime(v reflect.Value, s string, format string) error {
+	var t time.Time
+	switch format {
+	case "unix", "unixmilli":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid Unix timestamp %q", s)
+		}
+		t = time.Unix(n, 0)
+		if format == "unixmilli" {
+			t = time.Unix(n/1000, n%1000*int64(time.Millisecond))
+		}
+	default:
+		var err error
+		t, err = time.Parse(format, s)
+		if err != nil {
+			return fmt.Errorf("invalid time %q, expected the form %s", s, format)
+		}
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	v.Set(reflect.ValueOf(t))
+	return nil
+}
+
+// formatTime is the inverse of setTime
+func formatTime(v reflect.Value, format string) string {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	t := v.Interface().(time.Time)
+	switch format {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixmilli":
+		return strconv.FormatInt(t.Unix()*1000+int64(t.Nanosecond()/int(time.Millisecond)), 10)
+	default:
+		return t.Format(format)
+	}
+}
+
+// localize replaces Config.DecimalSeparator with "." in values for floating
+// point options
+func (p *Parser) localize(spec *spec, s string) string {
+	sep := p.config.DecimalSeparator
+	if sep == 0 || sep == '.' {
+		return s
+	}
+	t := sliceElem(spec.field.Type)
+	if t.Implements(textUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return s
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Float32 && t.Kind() != reflect.Float64 {
+		return s
+	}
+	return strings.Replace(s, string(sep), ".", 1)
+}
+
+// transform applies the transforms from the option's tag to s, in order
+func (s *spec) transform(value string) string {
+	for _, name := range s.transforms {
+		switch name {
+		case "lower":
+			value = strings.ToLower(value)
+		case "upper":
+			value = strings.ToUpper(value)
+		case "trim":
+			value = strings.TrimSpace(value)
+		}
+	}
+	return value
+}
+
+// setGivenValue is like setValue except that it applies the "invert"
+// modifier, which negates booleans given on the command line or in the
+// environment but not default values
+func (p *Parser) setGivenValue(spec *spec, s string) error {
+	if spec.invert {
+		var b bool
+		if err := setScalar(reflect.ValueOf(&b).Elem(), s); err != nil {
+			return err
+		}
+		s = strconv.FormatBool(!b)
+	}
+	return p.setValue(spec, s)
+}
+
+// setValues parses a sequence of strings into the field for a slice or map
+// option. If clear is true then any values already in the slice or map are
+// first removed.
+func (p *Parser) setValues(spec *spec, values []string, clear bool) error {
+	if len(spec.transforms) > 0 {
+		transformed := make([]string, len(values))
+		for i, s := range values {
+			transformed[i] = spec.transform(s)
+		}
+		values = transformed
+	}
+	if len(spec.choices) > 0 {
+		chosen := make([]string, len(values))
+		for i, s := range values {
+			var err error
+			if chosen[i], err = spec.choose(s); err != nil {
+				return err
+			}
+		}
+		values = chosen
+	}
+	if spec.separate && sliceElem(spec.field.Type).Kind() == reflect.Map {
+		// as with "-D NAME" for a C compiler, a key given alone has an
+		// empty value
+		defined := make([]string, len(values))
+		for i, s := range values {
+			defined[i] = s
+			if !strings.Contains(s, "=") {
+				defined[i] += "="
+			}
+		}
+		values = defined
+	}
+	if p.config.DecimalSeparator != 0 {
+		localized := make([]string, len(values))
+		for i, s := range values {
+			localized[i] = p.localize(spec, s)
+		}
+		values = localized
+	}
+	v := p.val(spec.dest)
+	if err := setSliceOrMap(v, values, clear, spec.format); err != nil {
+		return err
+	}
+	normalize(v)
+	if spec.unique {
+		return checkUnique(v)
+	}
+	return nil
+}
+
+// checkUnique returns an error if the slice v, or the slice it points to,
+// contains the same value more than once
+func checkUnique(v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < v.Len(); i++ {
+		s := formatValue(v.Index(i))
+		if seen[s] {
+			return fmt.Errorf("duplicate value %q", s)
+		}
+		seen[s] = true
+	}
+	return nil
+}
+
+// normalize calls Normalize on v if it implements Normalizer, or else on
+// each element of v if v is a slice
+func normalize(v reflect.Value) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return
+	}
+	if n, ok := v.Interface().(Normalizer); ok {
+		n.Normalize()
+		return
+	}
+	if v.CanAddr() {
+		if n, ok := v.Addr().Interface().(Normalizer); ok {
+			n.Normalize()
+			return
+		}
+	}
+	if v.Kind() == reflect.Slice {
+		for i := 0; i < v.Len(); i++ {
+			normalize(v.Index(i))
+		}
+	}
+}
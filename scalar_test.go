@@ -0,0 +1,80 @@
+package arg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetScalarBoolSpellings(t *testing.T) {
+	cases := map[string]bool{
+		"true":  true,
+		"1":     true,
+		"yes":   true,
+		"YES":   true,
+		"on":    true,
+		"false": false,
+		"0":     false,
+		"no":    false,
+		"Off":   false,
+	}
+	for s, expected := range cases {
+		b := !expected
+		err := setScalar(reflect.ValueOf(&b).Elem(), s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, b, s)
+	}
+}
+
+func TestSetScalarBoolPtr(t *testing.T) {
+	var b *bool
+	err := setScalar(reflect.ValueOf(&b).Elem(), "yes")
+	require.NoError(t, err)
+	require.NotNil(t, b)
+	assert.True(t, *b)
+}
+
+func TestSetScalarBoolInvalid(t *testing.T) {
+	var b bool
+	err := setScalar(reflect.ValueOf(&b).Elem(), "maybe")
+	assert.Error(t, err)
+}
+
+func TestSetScalarBoolUnmarshaler(t *testing.T) {
+	// custom unmarshalers must see the original text
+	var b boolUnmarshaler
+	err := setScalar(reflect.ValueOf(&b).Elem(), "yes")
+	require.NoError(t, err)
+	assert.EqualValues(t, false, b) // boolUnmarshaler is true for even-length input
+}
+
+// upperString is a string whose pointer, but not value, implements
+// TextUnmarshaler
+type upperString string
+
+func (s *upperString) UnmarshalText(b []byte) error {
+	*s = upperString(strings.ToUpper(string(b)))
+	return nil
+}
+
+func TestSetScalarPtrReceiverUnmarshaler(t *testing.T) {
+	// the pointer's UnmarshalText must take precedence over the string kind
+	var s upperString
+	err := setScalar(reflect.ValueOf(&s).Elem(), "abc")
+	require.NoError(t, err)
+	assert.Equal(t, upperString("ABC"), s)
+
+	var args struct {
+		Name  upperString
+		Names []upperString
+		Ptr   *upperString
+	}
+	err = parse("--name x --names y z --ptr w", &args)
+	require.NoError(t, err)
+	assert.Equal(t, upperString("X"), args.Name)
+	assert.Equal(t, []upperString{"Y", "Z"}, args.Names)
+	assert.Equal(t, upperString("W"), *args.Ptr)
+}
@@ -4,13 +4,12 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
-
-	scalar "github.com/alexflint/go-scalar"
 )
 
 // setSliceOrMap parses a sequence of strings into a slice or map. If clear is
-// true then any values already in the slice or map are first removed.
-func setSliceOrMap(dest reflect.Value, values []string, clear bool) error {
+// true then any values already in the slice or map are first removed. A
+// non-empty format is passed to setTime for each element of a time slice.
+func setSliceOrMap(dest reflect.Value, values []string, clear bool, format string) error {
 	if !dest.CanSet() {
 		return fmt.Errorf("field is not writable")
 	}
@@ -21,10 +20,14 @@ func setSliceOrMap(dest reflect.Value, values []string, clear bool) error {
 		t = t.Elem()
 	}
 
-	switch t.Kind() {
-	case reflect.Slice:
-		return setSlice(dest, values, clear)
-	case reflect.Map:
+	switch {
+	case t == nestedMapType:
+		return setNestedMap(dest, values, clear)
+	case t.Kind() == reflect.Struct:
+		return setStructPaths(dest, values, clear)
+	case t.Kind() == reflect.Slice:
+		return setSlice(dest, values, clear, format)
+	case t.Kind() == reflect.Map:
 		return setMap(dest, values, clear)
 	default:
 		return fmt.Errorf("setSliceOrMap cannot insert values into a %v", t)
@@ -32,8 +35,13 @@ func setSliceOrMap(dest reflect.Value, values []string, clear bool) error {
 }
 
 // setSlice parses a sequence of strings and inserts them into a slice. If clear
-// is true then any values already in the slice are removed.
-func setSlice(dest reflect.Value, values []string, clear bool) error {
+// is true then any values already in the slice are removed. If format is
+// non-empty then each element is parsed with setTime.
+func setSlice(dest reflect.Value, values []string, clear bool, format string) error {
+	if isTuple(dest.Type().Elem()) {
+		return setTuples(dest, values, clear)
+	}
+
 	var ptr bool
 	elem := dest.Type().Elem()
 	if elem.Kind() == reflect.Ptr && !elem.Implements(textUnmarshalerType) {
@@ -49,7 +57,13 @@ func setSlice(dest reflect.Value, values []string, clear bool) error {
 	// parse the values one-by-one
 	for _, s := range values {
 		v := reflect.New(elem)
-		if err := scalar.ParseValue(v.Elem(), s); err != nil {
+		var err error
+		if format != "" {
+			err = setTime(v.Elem(), s, format)
+		} else {
+			err = setScalar(v.Elem(), s)
+		}
+		if err != nil {
 			return err
 		}
 		if !ptr {
@@ -60,8 +74,38 @@ func setSlice(dest reflect.Value, values []string, clear bool) error {
 	return nil
 }
 
+// setTuples parses a sequence of strings into a slice of structs, filling the
+// fields of each struct in order from consecutive strings. If clear is true
+// then any values already in the slice are removed.
+func setTuples(dest reflect.Value, values []string, clear bool) error {
+	elem := dest.Type().Elem()
+	n := elem.NumField()
+	if len(values)%n != 0 {
+		return fmt.Errorf("expected values in groups of %d but got %d values", n, len(values))
+	}
+
+	// clear the slice in case default values exist
+	if clear && !dest.IsNil() {
+		dest.SetLen(0)
+	}
+
+	for len(values) > 0 {
+		v := reflect.New(elem).Elem()
+		for i := 0; i < n; i++ {
+			if err := setScalar(v.Field(i), values[i]); err != nil {
+				return err
+			}
+		}
+		dest.Set(reflect.Append(dest, v))
+		values = values[n:]
+	}
+	return nil
+}
+
 // setMap parses a sequence of name=value strings and inserts them into a map.
-// If clear is true then any values already in the map are removed.
+// If the values of the map are slices then each value is appended to the
+// slice for its key. If clear is true then any values already in the map are
+// removed.
 func setMap(dest reflect.Value, values []string, clear bool) error {
 	// determine the key and value type
 	var keyIsPtr bool
@@ -73,6 +117,10 @@ func setMap(dest reflect.Value, values []string, clear bool) error {
 
 	var valIsPtr bool
 	valType := dest.Type().Elem()
+	multimap := isMultimap(dest.Type())
+	if multimap {
+		valType = valType.Elem()
+	}
 	if valType.Kind() == reflect.Ptr && !valType.Implements(textUnmarshalerType) {
 		valIsPtr = true
 		valType = valType.Elem()
@@ -100,7 +148,7 @@ func setMap(dest reflect.Value, values []string, clear bool) error {
 
 		// parse the key
 		k := reflect.New(keyType)
-		if err := scalar.ParseValue(k.Elem(), s[:pos]); err != nil {
+		if err := setScalar(k.Elem(), s[:pos]); err != nil {
 			return err
 		}
 		if !keyIsPtr {
@@ -109,7 +157,7 @@ func setMap(dest reflect.Value, values []string, clear bool) error {
 
 		// parse the value
 		v := reflect.New(valType)
-		if err := scalar.ParseValue(v.Elem(), s[pos+1:]); err != nil {
+		if err := setScalar(v.Elem(), s[pos+1:]); err != nil {
 			return err
 		}
 		if !valIsPtr {
@@ -117,7 +165,152 @@ func setMap(dest reflect.Value, values []string, clear bool) error {
 		}
 
 		// add it to the map
+		if multimap {
+			existing := dest.MapIndex(k)
+			if !existing.IsValid() {
+				existing = reflect.Zero(dest.Type().Elem())
+			}
+			v = reflect.Append(existing, v)
+		}
 		dest.SetMapIndex(k, v)
 	}
 	return nil
 }
+
+// setNestedMap parses a sequence of path=value strings, where path is a
+// sequence of keys separated by dots, and inserts them into a
+// map[string]interface{}, creating nested maps for all but the last key. If
+// clear is true then any values already in the map are removed.
+func setNestedMap(dest reflect.Value, values []string, clear bool) error {
+	if clear || dest.IsNil() {
+		dest.Set(reflect.MakeMap(dest.Type()))
+	}
+	root := dest.Interface().(map[string]interface{})
+
+	for _, s := range values {
+		// split at the first equals sign
+		pos := strings.Index(s, "=")
+		if pos == -1 {
+			return fmt.Errorf("cannot parse %q into a map, expected format key.path=value", s)
+		}
+
+		keys := strings.Split(s[:pos], ".")
+		for _, key := range keys {
+			if key == "" {
+				return fmt.Errorf("invalid key path %q", s[:pos])
+			}
+		}
+
+		// walk down the path, creating maps as needed
+		m := root
+		for i, key := range keys[:len(keys)-1] {
+			switch child := m[key].(type) {
+			case nil:
+				next := make(map[string]interface{})
+				m[key] = next
+				m = next
+			case map[string]interface{}:
+				m = child
+			default:
+				return fmt.Errorf("cannot set %q because %q already has a value",
+					s[:pos], strings.Join(keys[:i+1], "."))
+			}
+		}
+
+		last := keys[len(keys)-1]
+		if _, isMap := m[last].(map[string]interface{}); isMap {
+			return fmt.Errorf("cannot set %q because it already contains nested keys", s[:pos])
+		}
+		m[last] = s[pos+1:]
+	}
+	return nil
+}
+
+// setStructPaths parses a sequence of path=value strings, where path is a
+// sequence of field names separated by dots, and sets the named fields of a
+// struct, descending into nested structs and map[string]interface{} fields.
+// Field names are matched regardless of case. If clear is true then the
+// struct is first reset to its zero value.
+func setStructPaths(dest reflect.Value, values []string, clear bool) error {
+	if clear {
+		dest.Set(reflect.Zero(dest.Type()))
+	}
+	for _, s := range values {
+		// split at the first equals sign
+		pos := strings.Index(s, "=")
+		if pos == -1 {
+			return fmt.Errorf("cannot parse %q into a struct, expected format field.path=value", s)
+		}
+		if err := setStructPath(dest, s[:pos], s[pos+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setStructPath sets the field of the struct v named by a dotted path
+func setStructPath(v reflect.Value, path, value string) error {
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		if key == "" {
+			return fmt.Errorf("invalid field path %q", path)
+		}
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if v.Type() == nestedMapType {
+			// the rest of the path consists of map keys
+			return setNestedMap(v, []string{strings.Join(keys[i:], ".") + "=" + value}, false)
+		}
+		if v.Kind() != reflect.Struct || canParse(v.Type()) {
+			return fmt.Errorf("cannot set %q because %q is not a struct", path, strings.Join(keys[:i], "."))
+		}
+		field, ok := findField(v.Type(), key)
+		if !ok {
+			return fmt.Errorf("cannot set %q because %v has no field %q", path, v.Type(), key)
+		}
+		v = v.FieldByIndex(field.Index)
+	}
+
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct && !canParse(t) {
+		return fmt.Errorf("cannot set %q because it is a struct, set its fields instead", path)
+	}
+	if err := setScalar(v, value); err != nil {
+		return fmt.Errorf("error setting %q: %w", path, err)
+	}
+	return nil
+}
+
+// findField finds the exported field of a struct with the given name,
+// regardless of case
+func findField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath == "" && strings.EqualFold(field.Name, name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// splitValues splits each of the given strings on sep and returns the
+// concatenated pieces. It is an error for any piece to be empty.
+func splitValues(values []string, sep string) ([]string, error) {
+	var out []string
+	for _, v := range values {
+		for _, piece := range strings.Split(v, sep) {
+			if piece == "" {
+				return nil, fmt.Errorf("empty value in %q (separator is %q)", v, sep)
+			}
+			out = append(out, piece)
+		}
+	}
+	return out, nil
+}
@@ -11,7 +11,7 @@ import (
 func TestSetSliceWithoutClearing(t *testing.T) {
 	xs := []int{10}
 	entries := []string{"1", "2", "3"}
-	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, false)
+	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, false, "")
 	require.NoError(t, err)
 	assert.Equal(t, []int{10, 1, 2, 3}, xs)
 }
@@ -19,7 +19,7 @@ func TestSetSliceWithoutClearing(t *testing.T) {
 func TestSetSliceAfterClearing(t *testing.T) {
 	xs := []int{100}
 	entries := []string{"1", "2", "3"}
-	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true)
+	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true, "")
 	require.NoError(t, err)
 	assert.Equal(t, []int{1, 2, 3}, xs)
 }
@@ -27,14 +27,14 @@ func TestSetSliceAfterClearing(t *testing.T) {
 func TestSetSliceInvalid(t *testing.T) {
 	xs := []int{100}
 	entries := []string{"invalid"}
-	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true)
+	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true, "")
 	assert.Error(t, err)
 }
 
 func TestSetSlicePtr(t *testing.T) {
 	var xs []*int
 	entries := []string{"1", "2", "3"}
-	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true)
+	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true, "")
 	require.NoError(t, err)
 	require.Len(t, xs, 3)
 	assert.Equal(t, 1, *xs[0])
@@ -46,7 +46,7 @@ func TestSetSliceTextUnmarshaller(t *testing.T) {
 	// textUnmarshaler is a struct that captures the length of the string passed to it
 	var xs []*textUnmarshaler
 	entries := []string{"a", "aa", "aaa"}
-	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true)
+	err := setSlice(reflect.ValueOf(&xs).Elem(), entries, true, "")
 	require.NoError(t, err)
 	require.Len(t, xs, 3)
 	assert.Equal(t, 1, xs[0].val)
@@ -120,6 +120,26 @@ func TestSetMapInvalidValue(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSetMapValueWithEquals(t *testing.T) {
+	var m map[string]string
+	entries := []string{"key=a=b=c", "token=YWJj==", "empty="}
+	err := setMap(reflect.ValueOf(&m).Elem(), entries, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "a=b=c", "token": "YWJj==", "empty": ""}, m)
+}
+
+func TestSetMultimap(t *testing.T) {
+	m := map[string][]int{"a": {1}}
+	entries := []string{"a=2", "b=3", "a=4"}
+	err := setMap(reflect.ValueOf(&m).Elem(), entries, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]int{"a": {1, 2, 4}, "b": {3}}, m)
+
+	err = setMap(reflect.ValueOf(&m).Elem(), []string{"c=5"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]int{"c": {5}}, m)
+}
+
 func TestSetMapMalformed(t *testing.T) {
 	// textUnmarshaler is a struct that captures the length of the string passed to it
 	var m map[string]string
@@ -135,18 +155,61 @@ func TestSetSliceOrMapErrors(t *testing.T) {
 	// converting a slice to a reflect.Value in this way will make it read only
 	var cannotSet []int
 	dest = reflect.ValueOf(cannotSet)
-	err = setSliceOrMap(dest, nil, false)
+	err = setSliceOrMap(dest, nil, false, "")
 	assert.Error(t, err)
 
 	// check what happens when we pass in something that is not a slice or a map
 	var notSliceOrMap string
 	dest = reflect.ValueOf(&notSliceOrMap).Elem()
-	err = setSliceOrMap(dest, nil, false)
+	err = setSliceOrMap(dest, nil, false, "")
 	assert.Error(t, err)
 
 	// check what happens when we pass in a pointer to something that is not a slice or a map
 	var stringPtr *string
 	dest = reflect.ValueOf(&stringPtr).Elem()
-	err = setSliceOrMap(dest, nil, false)
+	err = setSliceOrMap(dest, nil, false, "")
 	assert.Error(t, err)
 }
+
+func TestSetNestedMap(t *testing.T) {
+	var m map[string]interface{}
+	entries := []string{"a.b=1", "a.c=2", "d=3"}
+	err := setNestedMap(reflect.ValueOf(&m).Elem(), entries, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{"b": "1", "c": "2"},
+		"d": "3",
+	}, m)
+}
+
+func TestSetNestedMapInvalidPath(t *testing.T) {
+	var m map[string]interface{}
+	err := setNestedMap(reflect.ValueOf(&m).Elem(), []string{"a..b=1"}, true)
+	assert.EqualError(t, err, `invalid key path "a..b"`)
+
+	err = setNestedMap(reflect.ValueOf(&m).Elem(), []string{"a.b"}, true)
+	assert.Error(t, err)
+}
+
+func TestSetNestedMapConflict(t *testing.T) {
+	var m map[string]interface{}
+	err := setNestedMap(reflect.ValueOf(&m).Elem(), []string{"a=1", "a.b=2"}, true)
+	assert.EqualError(t, err, `cannot set "a.b" because "a" already has a value`)
+
+	err = setNestedMap(reflect.ValueOf(&m).Elem(), []string{"a.b=1", "a=2"}, true)
+	assert.EqualError(t, err, `cannot set "a" because it already contains nested keys`)
+}
+
+func TestSetStructPaths(t *testing.T) {
+	s := settings{Debug: true}
+	err := setStructPaths(reflect.ValueOf(&s).Elem(), []string{"db.host=a", "DB.Port=1"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, settings{DB: dbSettings{Host: "a", Port: 1}, Debug: true}, s)
+
+	err = setStructPaths(reflect.ValueOf(&s).Elem(), []string{"cache.port=2"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, settings{Cache: &dbSettings{Port: 2}}, s)
+
+	err = setStructPaths(reflect.ValueOf(&s).Elem(), []string{"debug"}, false)
+	assert.EqualError(t, err, `cannot parse "debug" into a struct, expected format field.path=value`)
+}
@@ -35,3 +35,18 @@ func (p *Parser) SubcommandNames() []string {
 	}
 	return out
 }
+
+// HasSubcommands returns true if the top-level command has any subcommands.
+func (p *Parser) HasSubcommands() bool {
+	return len(p.cmd.subcommands) > 0
+}
+
+// Subcommands returns the names of the top-level subcommands in the order in
+// which they were declared.
+func (p *Parser) Subcommands() []string {
+	var names []string
+	for _, cmd := range p.cmd.subcommands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
@@ -1,6 +1,8 @@
 package arg
 
 import (
+	"bytes"
+	"errors"
 	"reflect"
 	"testing"
 
@@ -27,13 +29,49 @@ func TestSubcommandNotAPointerToStruct(t *testing.T) {
 	assert.Error(t, err)
 }
 
-func TestPositionalAndSubcommandNotAllowed(t *testing.T) {
+func TestSlicePositionalAndSubcommandNotAllowed(t *testing.T) {
 	var args struct {
-		A string    `arg:"positional"`
+		A []string  `arg:"positional"`
 		B *struct{} `arg:"subcommand"`
 	}
 	_, err := NewParser(Config{}, &args)
-	assert.Error(t, err)
+	assert.EqualError(t, err, "args cannot have both subcommands and a slice positional argument")
+}
+
+func TestPositionalsBeforeSubcommand(t *testing.T) {
+	type deployCmd struct {
+		App     string   `arg:"positional"`
+		Targets []string `arg:"positional"`
+	}
+	var args struct {
+		Region  string `arg:"positional"`
+		Zone    string `arg:"positional"`
+		Verbose bool
+		Deploy  *deployCmd `arg:"subcommand"`
+	}
+	p, err := pparse("us-east zone-a --verbose deploy web a b", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "us-east", args.Region)
+	assert.Equal(t, "zone-a", args.Zone)
+	assert.True(t, args.Verbose)
+	require.NotNil(t, args.Deploy)
+	assert.Equal(t, "web", args.Deploy.App)
+	assert.Equal(t, []string{"a", "b"}, args.Deploy.Targets)
+	assert.Equal(t, []string{"deploy"}, p.SubcommandNames())
+}
+
+func TestPositionalsTakePrecedenceOverSubcommand(t *testing.T) {
+	var args struct {
+		Region string    `arg:"positional"`
+		Deploy *struct{} `arg:"subcommand"`
+	}
+	err := parse("deploy", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "deploy", args.Region)
+	assert.Nil(t, args.Deploy)
+
+	err = parse("us-east nope", &args)
+	assert.EqualError(t, err, "invalid subcommand: nope")
 }
 
 func TestMinimalSubcommand(t *testing.T) {
@@ -411,3 +449,244 @@ func TestValForNilStruct(t *testing.T) {
 	v := p.val(path{fields: []reflect.StructField{subField, subField}})
 	assert.False(t, v.IsValid())
 }
+
+func TestDefaultSubcommandExplicitSelection(t *testing.T) {
+	type serveCmd struct {
+		Port int
+	}
+	type buildCmd struct {
+		Target string `arg:"positional"`
+	}
+	var args struct {
+		Serve *serveCmd `arg:"subcommand:serve,default"`
+		Build *buildCmd `arg:"subcommand:build"`
+	}
+	p, err := pparse("build foo", &args)
+	require.NoError(t, err)
+	assert.Nil(t, args.Serve)
+	require.NotNil(t, args.Build)
+	assert.Equal(t, "foo", args.Build.Target)
+	assert.Equal(t, []string{"build"}, p.SubcommandNames())
+}
+
+func TestDefaultSubcommandFallback(t *testing.T) {
+	type serveCmd struct {
+		Port int
+		Dir  string `arg:"positional"`
+	}
+	type buildCmd struct{}
+	var args struct {
+		Verbose bool
+		Serve   *serveCmd `arg:"subcommand:serve,default"`
+		Build   *buildCmd `arg:"subcommand:build"`
+	}
+	p, err := pparse("--verbose --port 8080 public", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Verbose)
+	assert.Nil(t, args.Build)
+	require.NotNil(t, args.Serve)
+	assert.Equal(t, 8080, args.Serve.Port)
+	assert.Equal(t, "public", args.Serve.Dir)
+	assert.Equal(t, []string{"serve"}, p.SubcommandNames())
+	assert.Equal(t, args.Serve, p.Subcommand())
+}
+
+func TestDefaultSubcommandNoArguments(t *testing.T) {
+	type serveCmd struct{}
+	var args struct {
+		Serve *serveCmd `arg:"subcommand:serve,default"`
+	}
+	p, err := pparse("", &args)
+	require.NoError(t, err)
+	assert.NotNil(t, args.Serve)
+	assert.Equal(t, []string{"serve"}, p.SubcommandNames())
+}
+
+func TestDefaultSubcommandDefaultsAndEnv(t *testing.T) {
+	type serveCmd struct {
+		Port  int    `default:"8080"`
+		Root  string `arg:"env:SERVE_ROOT"`
+		Debug *struct {
+			Level string `default:"info"`
+		} `arg:"subcommand:debug,default"`
+	}
+	var args struct {
+		Serve *serveCmd `arg:"subcommand:serve,default"`
+	}
+
+	p, err := parseWithEnv("", []string{"SERVE_ROOT=/srv"}, &args)
+	require.NoError(t, err)
+	require.NotNil(t, args.Serve)
+	assert.Equal(t, 8080, args.Serve.Port)
+	assert.Equal(t, "/srv", args.Serve.Root)
+	require.NotNil(t, args.Serve.Debug)
+	assert.Equal(t, "info", args.Serve.Debug.Level)
+	assert.Equal(t, SourceDefault, p.Source("port"))
+	assert.Equal(t, SourceEnv, p.Source("root"))
+}
+
+func TestDefaultSubcommandUnknownArgument(t *testing.T) {
+	type serveCmd struct{}
+	var args struct {
+		Serve *serveCmd `arg:"subcommand:serve,default"`
+	}
+	err := parse("--nope", &args)
+	assert.EqualError(t, err, "unknown argument --nope")
+
+	err = parse("nope", &args)
+	assert.EqualError(t, err, "this command takes no positional arguments, got 'nope'")
+}
+
+func TestMultipleDefaultSubcommands(t *testing.T) {
+	var args struct {
+		A *struct{} `arg:"subcommand,default"`
+		B *struct{} `arg:"subcommand,default"`
+	}
+	_, err := NewParser(Config{}, &args)
+	assert.EqualError(t, err, ".B: only one subcommand can be the default")
+}
+
+func TestDefaultOnlyForSubcommands(t *testing.T) {
+	var args struct {
+		A string `arg:"default"`
+	}
+	_, err := NewParser(Config{}, &args)
+	assert.EqualError(t, err, ".A: 'default' can only be used with subcommands")
+}
+
+func TestAbbreviatedSubcommand(t *testing.T) {
+	var args struct {
+		Commit *struct{} `arg:"subcommand:commit"`
+		Config *struct{} `arg:"subcommand:config"`
+		Co     *struct{} `arg:"subcommand:co"`
+	}
+	p, err := NewParser(Config{AllowAbbrevSubcommands: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"com"})
+	require.NoError(t, err)
+	assert.NotNil(t, args.Commit)
+	assert.Equal(t, []string{"commit"}, p.SubcommandNames())
+
+	err = p.Parse([]string{"co"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"co"}, p.SubcommandNames())
+
+	err = p.Parse([]string{"c"})
+	assert.EqualError(t, err, "ambiguous subcommand c: could be commit, config, co")
+}
+
+func TestAbbreviatedSubcommandDisabled(t *testing.T) {
+	var args struct {
+		Commit *struct{} `arg:"subcommand:commit"`
+	}
+	err := parse("com", &args)
+	assert.EqualError(t, err, "invalid subcommand: com")
+}
+
+func TestListSubcommands(t *testing.T) {
+	var args struct {
+		Verbose bool
+		Get     *struct{} `arg:"subcommand"`
+		Put     *struct{} `arg:"subcommand:upload"`
+		Delete  *struct {
+			All *struct{} `arg:"subcommand"`
+		} `arg:"subcommand"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	assert.True(t, p.HasSubcommands())
+	assert.Equal(t, []string{"get", "upload", "delete"}, p.Subcommands())
+}
+
+func TestListSubcommandsNone(t *testing.T) {
+	var args struct {
+		Verbose bool
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	assert.False(t, p.HasSubcommands())
+	assert.Empty(t, p.Subcommands())
+}
+
+// ranCommands records the names of the runCmd subcommands that have run
+var ranCommands []string
+
+// runCmd is a subcommand that implements Runner
+type runCmd struct {
+	Name string
+	Fail bool
+}
+
+func (c *runCmd) Run() error {
+	ranCommands = append(ranCommands, c.Name)
+	if c.Fail {
+		return errors.New("run failed")
+	}
+	return nil
+}
+
+func TestAutoRun(t *testing.T) {
+	var args struct {
+		Start *runCmd `arg:"subcommand"`
+		Stop  *runCmd `arg:"subcommand"`
+	}
+	p, err := NewParser(Config{AutoRun: true}, &args)
+	require.NoError(t, err)
+
+	ranCommands = nil
+	err = p.Parse([]string{"start", "--name", "web"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web"}, ranCommands)
+	assert.Nil(t, args.Stop)
+
+	ranCommands = nil
+	err = p.Parse([]string{"stop", "--name", "db", "--fail"})
+	assert.EqualError(t, err, "run failed")
+	var runErr *RunError
+	assert.True(t, errors.As(err, &runErr))
+	assert.Equal(t, []string{"db"}, ranCommands)
+
+	ranCommands = nil
+	err = p.Parse([]string{"stop", "--nope"})
+	assert.Error(t, err)
+	assert.Empty(t, ranCommands)
+}
+
+func TestAutoRunErrorWithoutUsage(t *testing.T) {
+	var args struct {
+		Start *runCmd `arg:"subcommand"`
+	}
+	var stderr bytes.Buffer
+	var exitCode int
+	p, err := NewParser(Config{
+		Program: "example",
+		AutoRun: true,
+		Err:     &stderr,
+		Exit:    func(code int) { exitCode = code },
+	}, &args)
+	require.NoError(t, err)
+
+	ranCommands = nil
+	p.MustParse([]string{"start", "--fail"})
+	assert.Equal(t, -1, exitCode)
+	assert.Equal(t, "error: run failed\n", stderr.String())
+}
+
+func TestAutoRunWithDeferValidation(t *testing.T) {
+	var args struct {
+		Start *runCmd `arg:"subcommand"`
+	}
+	_, err := NewParser(Config{AutoRun: true, DeferValidation: true}, &args)
+	assert.EqualError(t, err, "AutoRun cannot be used with DeferValidation")
+}
+
+func TestAutoRunDisabled(t *testing.T) {
+	var args struct {
+		Start *runCmd `arg:"subcommand"`
+	}
+	ranCommands = nil
+	err := parse("start --name web", &args)
+	require.NoError(t, err)
+	assert.Empty(t, ranCommands)
+}
@@ -1,15 +1,26 @@
 package arg
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"strings"
 )
 
 // the width of the left column
 const colWidth = 25
 
+// Names of the sections of the help text, for use in Config.SectionOrder
+const (
+	SectionPositionals = "positionals"
+	SectionOptions     = "options"
+	SectionGlobals     = "globals"
+	SectionCommands    = "commands"
+	SectionEnvironment = "environment"
+)
+
 // to allow monkey patching in tests
 var (
 	stdout io.Writer = os.Stdout
@@ -17,7 +28,39 @@ var (
 	osExit           = os.Exit
 )
 
-// Fail prints usage information to stderr and exits with non-zero status
+// out returns the writer for help and version information
+func (p *Parser) out() io.Writer {
+	if p.config.Output != nil {
+		return p.config.Output
+	}
+	if p.config.Out != nil {
+		return p.config.Out
+	}
+	return stdout
+}
+
+// err returns the writer for usage errors
+func (p *Parser) err() io.Writer {
+	if p.config.Output != nil {
+		return p.config.Output
+	}
+	if p.config.Err != nil {
+		return p.config.Err
+	}
+	return stderr
+}
+
+// exit terminates the program with the given status
+func (p *Parser) exit(code int) {
+	if p.config.Exit != nil {
+		p.config.Exit(code)
+		return
+	}
+	osExit(code)
+}
+
+// Fail prints usage information to Config.Err (stderr by default) and exits
+// with non-zero status
 func (p *Parser) Fail(msg string) {
 	p.failWithSubcommand(msg, p.cmd)
 }
@@ -39,9 +82,9 @@ func (p *Parser) FailSubcommand(msg string, subcommand ...string) error {
 
 // failWithSubcommand prints usage information for the given subcommand to stderr and exits with non-zero status
 func (p *Parser) failWithSubcommand(msg string, cmd *command) {
-	p.writeUsageForSubcommand(stderr, cmd)
-	fmt.Fprintln(stderr, "error:", msg)
-	osExit(-1)
+	p.writeUsageForSubcommand(p.err(), cmd)
+	fmt.Fprintln(p.err(), "error:", msg)
+	p.exit(-1)
 }
 
 // WriteUsage writes usage information to the given writer
@@ -70,8 +113,11 @@ func (p *Parser) WriteUsageForSubcommand(w io.Writer, subcommand ...string) erro
 // writeUsageForSubcommand writes usage information for the given subcommand
 func (p *Parser) writeUsageForSubcommand(w io.Writer, cmd *command) {
 	var positionals, longOptions, shortOptions []*spec
+	var passthrough *spec
 	for _, spec := range cmd.specs {
 		switch {
+		case spec.passthrough:
+			passthrough = spec
 		case spec.positional:
 			positionals = append(positionals, spec)
 		case spec.long != "":
@@ -106,7 +152,7 @@ func (p *Parser) writeUsageForSubcommand(w io.Writer, cmd *command) {
 		if !spec.required {
 			fmt.Fprint(w, "[")
 		}
-		fmt.Fprint(w, synopsis(spec, "-"+spec.short))
+		fmt.Fprint(w, usageSynopsis(spec, "-"+spec.short))
 		if !spec.required {
 			fmt.Fprint(w, "]")
 		}
@@ -118,7 +164,7 @@ func (p *Parser) writeUsageForSubcommand(w io.Writer, cmd *command) {
 		if !spec.required {
 			fmt.Fprint(w, "[")
 		}
-		fmt.Fprint(w, synopsis(spec, "--"+spec.long))
+		fmt.Fprint(w, usageSynopsis(spec, "--"+spec.long))
 		if !spec.required {
 			fmt.Fprint(w, "]")
 		}
@@ -129,11 +175,17 @@ func (p *Parser) writeUsageForSubcommand(w io.Writer, cmd *command) {
 		// prefix with a space
 		fmt.Fprint(w, " ")
 		if spec.cardinality == multiple {
-			if !spec.required {
+			// a min tag makes the values mandatory, so spell out as many of
+			// them as it demands
+			optional := !spec.required && spec.min == 0
+			if optional {
 				fmt.Fprint(w, "[")
 			}
+			for i := 1; i < spec.min; i++ {
+				fmt.Fprint(w, spec.placeholder+" ")
+			}
 			fmt.Fprintf(w, "%s [%s ...]", spec.placeholder, spec.placeholder)
-			if !spec.required {
+			if optional {
 				fmt.Fprint(w, "]")
 			}
 		} else {
@@ -146,19 +198,21 @@ func (p *Parser) writeUsageForSubcommand(w io.Writer, cmd *command) {
 		fmt.Fprint(w, " <command> [<args>]")
 	}
 
+	// if the program accepts arguments after "--", say so
+	if passthrough != nil {
+		fmt.Fprintf(w, " [-- %s...]", passthrough.placeholder)
+	}
+
 	fmt.Fprint(w, "\n")
 }
 
-func printTwoCols(w io.Writer, left, help string, defaultVal string, envVal string) {
-	lhs := "  " + left
-	fmt.Fprint(w, lhs)
-	if help != "" {
-		if len(lhs)+2 < colWidth {
-			fmt.Fprint(w, strings.Repeat(" ", colWidth-len(lhs)))
-		} else {
-			fmt.Fprint(w, "\n"+strings.Repeat(" ", colWidth))
-		}
-		fmt.Fprint(w, help)
+// printTwoCols writes one entry of the help text, with the help starting at
+// the help column, or on a line of its own if the left column is too wide.
+// If Config.HelpWidth is set then the help is wrapped to fit within it.
+func (p *Parser) printTwoCols(w io.Writer, left, help string, defaultVal string, envVal string) {
+	width := p.config.HelpColumn
+	if width <= 0 {
+		width = colWidth
 	}
 
 	bracketsContent := []string{}
@@ -175,12 +229,47 @@ func printTwoCols(w io.Writer, left, help string, defaultVal string, envVal stri
 		)
 	}
 
+	rhs := help
 	if len(bracketsContent) > 0 {
-		fmt.Fprintf(w, " [%s]", strings.Join(bracketsContent, ", "))
+		rhs += fmt.Sprintf(" [%s]", strings.Join(bracketsContent, ", "))
+	}
+
+	lhs := "  " + left
+	fmt.Fprint(w, lhs)
+	if help != "" {
+		if len(lhs)+2 < width {
+			fmt.Fprint(w, strings.Repeat(" ", width-len(lhs)))
+		} else {
+			fmt.Fprint(w, "\n"+strings.Repeat(" ", width))
+		}
+		if p.config.HelpWidth > width {
+			lines := wrapWords(rhs, p.config.HelpWidth-width)
+			rhs = strings.Join(lines, "\n"+strings.Repeat(" ", width))
+		}
 	}
+	fmt.Fprint(w, rhs)
 	fmt.Fprint(w, "\n")
 }
 
+// wrapWords splits s into lines of at most n characters, breaking between
+// words. A word longer than n is put on a line by itself.
+func wrapWords(s string, n int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(s) {
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= n:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	return append(lines, line)
+}
+
 // WriteHelp writes the usage string followed by the full help string for each option
 func (p *Parser) WriteHelp(w io.Writer) {
 	cmd := p.cmd
@@ -209,7 +298,7 @@ func (p *Parser) writeHelpForSubcommand(w io.Writer, cmd *command) {
 	var positionals, longOptions, shortOptions []*spec
 	for _, spec := range cmd.specs {
 		switch {
-		case spec.positional:
+		case spec.positional, spec.passthrough:
 			positionals = append(positionals, spec)
 		case spec.long != "":
 			longOptions = append(longOptions, spec)
@@ -218,53 +307,126 @@ func (p *Parser) writeHelpForSubcommand(w io.Writer, cmd *command) {
 		}
 	}
 
-	if p.description != "" {
-		fmt.Fprintln(w, p.description)
+	// obtain a flattened list of options from all ancestors
+	var globals []*spec
+	ancestor := cmd.parent
+	for ancestor != nil && !p.config.HideGlobalOptions {
+		for _, spec := range ancestor.specs {
+			// positionals of a parent command are not available to subcommands
+			if !spec.positional && !spec.passthrough {
+				globals = append(globals, spec)
+			}
+		}
+		ancestor = ancestor.parent
+	}
+
+	if description := p.describe(); description != "" {
+		fmt.Fprintln(w, description)
 	}
 	p.writeUsageForSubcommand(w, cmd)
 
-	// write the list of positionals
-	if len(positionals) > 0 {
-		fmt.Fprint(w, "\nPositional arguments:\n")
-		for _, spec := range positionals {
-			printTwoCols(w, spec.placeholder, spec.help, "", "")
+	for _, section := range p.sectionOrder() {
+		switch section {
+		case SectionPositionals:
+			// write the list of positionals
+			if len(positionals) > 0 {
+				fmt.Fprintf(w, "\n%s\n", heading(p.config.PositionalsHeading, "Positional arguments:"))
+				for _, spec := range positionals {
+					p.printTwoCols(w, spec.placeholder, spec.help, spec.displayDefault(), p.envVar(spec))
+				}
+			}
+		case SectionOptions:
+			// write the list of options with the short-only ones first to match the usage string
+			if len(shortOptions)+len(longOptions) > 0 || cmd.parent == nil {
+				fmt.Fprintf(w, "\n%s\n", heading(p.config.OptionsHeading, "Options:"))
+				for _, spec := range shortOptions {
+					p.printOption(w, spec)
+				}
+				for _, spec := range longOptions {
+					p.printOption(w, spec)
+				}
+			}
+			if len(globals) == 0 {
+				p.printBuiltinOptions(w, cmd)
+			}
+		case SectionGlobals:
+			// write the list of global options
+			if len(globals) > 0 {
+				fmt.Fprintf(w, "\n%s\n", heading(p.config.GlobalsHeading, "Global options:"))
+				for _, spec := range globals {
+					p.printOption(w, spec)
+				}
+				p.printBuiltinOptions(w, cmd)
+			}
+		case SectionCommands:
+			// write the list of subcommands
+			if len(cmd.subcommands) > 0 {
+				fmt.Fprintf(w, "\n%s\n", heading(p.config.CommandsHeading, "Commands:"))
+				p.printCommands(w, cmd.subcommands, 0)
+			}
+		case SectionEnvironment:
+			// write the list of environment variables, including those of
+			// options that cannot be given on the command line
+			if !p.config.ShowEnvSection {
+				continue
+			}
+			// build a fresh slice so as not to write into the spare
+			// capacity of cmd.specs
+			candidates := make([]*spec, 0, len(cmd.specs)+len(globals))
+			candidates = append(candidates, cmd.specs...)
+			candidates = append(candidates, globals...)
+			var envSpecs []*spec
+			for _, spec := range candidates {
+				if p.envVar(spec) != "" {
+					envSpecs = append(envSpecs, spec)
+				}
+			}
+			if len(envSpecs) > 0 {
+				fmt.Fprintf(w, "\n%s\n", heading(p.config.EnvironmentHeading, "Environment variables:"))
+				for _, spec := range envSpecs {
+					p.printTwoCols(w, spec.env, spec.help, spec.displayDefault(), "")
+				}
+			}
 		}
 	}
+}
 
-	// write the list of options with the short-only ones first to match the usage string
-	if len(shortOptions)+len(longOptions) > 0 || cmd.parent == nil {
-		fmt.Fprint(w, "\nOptions:\n")
-		for _, spec := range shortOptions {
-			p.printOption(w, spec)
-		}
-		for _, spec := range longOptions {
-			p.printOption(w, spec)
+// printCommands writes the help entries for a list of subcommands. If
+// Config.ShowCommandTree is set then their descendants are listed too, each
+// level indented under its parent.
+func (p *Parser) printCommands(w io.Writer, cmds []*command, depth int) {
+	for _, cmd := range cmds {
+		p.printTwoCols(w, strings.Repeat("  ", depth)+cmd.name, cmd.help, "", "")
+		if p.config.ShowCommandTree {
+			p.printCommands(w, cmd.subcommands, depth+1)
 		}
 	}
+}
 
-	// obtain a flattened list of options from all ancestors
-	var globals []*spec
-	ancestor := cmd.parent
-	for ancestor != nil {
-		globals = append(globals, ancestor.specs...)
-		ancestor = ancestor.parent
+// heading returns the configured heading for a section of the help text, or
+// the default if none was configured
+func heading(configured, def string) string {
+	if configured != "" {
+		return configured
 	}
+	return def
+}
 
-	// write the list of global options
-	if len(globals) > 0 {
-		fmt.Fprint(w, "\nGlobal options:\n")
-		for _, spec := range globals {
-			p.printOption(w, spec)
+// printBuiltinOptions writes the help entries for --help and --version as
+// they apply to the given command
+func (p *Parser) printBuiltinOptions(w io.Writer, cmd *command) {
+	// list the long forms of the help flags first to match the other options
+	var long, short []string
+	for _, flag := range p.helpFlags(specsInScope(cmd)) {
+		if strings.HasPrefix(flag, "--") {
+			long = append(long, flag)
+		} else {
+			short = append(short, flag)
 		}
 	}
-
-	// write the list of built in options
-	p.printOption(w, &spec{
-		cardinality: zero,
-		long:        "help",
-		short:       "h",
-		help:        "display this help and exit",
-	})
+	if flags := append(long, short...); len(flags) > 0 {
+		p.printTwoCols(w, strings.Join(flags, ", "), "display this help and exit", "", "")
+	}
 	if p.version != "" {
 		p.printOption(w, &spec{
 			cardinality: zero,
@@ -272,26 +434,145 @@ func (p *Parser) writeHelpForSubcommand(w io.Writer, cmd *command) {
 			help:        "display version and exit",
 		})
 	}
+}
 
-	// write the list of subcommands
-	if len(cmd.subcommands) > 0 {
-		fmt.Fprint(w, "\nCommands:\n")
-		for _, subcmd := range cmd.subcommands {
-			printTwoCols(w, subcmd.name, subcmd.help, "", "")
+// sectionOrder returns the order in which to write the sections of the help
+// text. Sections from Config.SectionOrder come first, unknown names are
+// ignored, and any sections not mentioned follow in the default order.
+func (p *Parser) sectionOrder() []string {
+	defaults := []string{SectionPositionals, SectionOptions, SectionGlobals, SectionCommands, SectionEnvironment}
+
+	var order []string
+	seen := make(map[string]bool)
+	for _, section := range append(p.config.SectionOrder, defaults...) {
+		if seen[section] {
+			continue
+		}
+		for _, known := range defaults {
+			if section == known {
+				order = append(order, section)
+				seen[section] = true
+			}
 		}
 	}
+	return order
+}
+
+// commandJSON is the structure written by WriteUsageJSON for each command
+type commandJSON struct {
+	Name        string         `json:"name"`
+	Help        string         `json:"help,omitempty"`
+	Version     string         `json:"version,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Options     []optionJSON   `json:"options"`
+	Positionals []optionJSON   `json:"positionals"`
+	Subcommands []*commandJSON `json:"subcommands"`
+}
+
+// optionJSON is the structure written by WriteUsageJSON for each option
+type optionJSON struct {
+	Long        string `json:"long,omitempty"`
+	Short       string `json:"short,omitempty"`
+	Help        string `json:"help,omitempty"`
+	Required    bool   `json:"required"`
+	Multiple    bool   `json:"multiple"`
+	Default     string `json:"default,omitempty"`
+	Env         string `json:"env,omitempty"`
+	Placeholder string `json:"placeholder"`
+}
+
+// describe returns the description of the program, which comes from the
+// Described interface or else from a string field named Description that is
+// excluded from the command line with arg:"-", read at the time of the call so
+// that the program can set it after constructing the parser
+func (p *Parser) describe() string {
+	if p.description != "" {
+		return p.description
+	}
+	for _, root := range p.roots {
+		v := reflect.Indirect(root)
+		if v.Kind() != reflect.Struct {
+			continue
+		}
+		field, ok := v.Type().FieldByName("Description")
+		if !ok || len(field.Index) != 1 || field.Type.Kind() != reflect.String {
+			continue
+		}
+		if _, hasEnv := field.Tag.Lookup("env"); field.Tag.Get("arg") != "-" || hasEnv {
+			continue
+		}
+		if description := v.Field(field.Index[0]).String(); description != "" {
+			return description
+		}
+	}
+	return ""
+}
+
+// WriteUsageJSON writes a machine-readable description of the program's
+// options, positional arguments, and subcommands to the given writer
+func (p *Parser) WriteUsageJSON(w io.Writer) error {
+	root := commandToJSON(p.cmd)
+	root.Version = p.version
+	root.Description = p.describe()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(root)
+}
+
+// commandToJSON converts a command and its subcommands to their JSON form
+func commandToJSON(cmd *command) *commandJSON {
+	out := commandJSON{
+		Name:        cmd.name,
+		Help:        cmd.help,
+		Options:     []optionJSON{},
+		Positionals: []optionJSON{},
+		Subcommands: []*commandJSON{},
+	}
+	for _, spec := range cmd.specs {
+		opt := optionJSON{
+			Help:        spec.help,
+			Required:    spec.required,
+			Multiple:    spec.cardinality == multiple,
+			Default:     spec.displayDefault(),
+			Env:         spec.env,
+			Placeholder: spec.placeholder,
+		}
+		if spec.positional || spec.passthrough {
+			out.Positionals = append(out.Positionals, opt)
+			continue
+		}
+		if spec.long != "" {
+			opt.Long = "--" + spec.long
+		}
+		if spec.short != "" {
+			opt.Short = "-" + spec.short
+		}
+		out.Options = append(out.Options, opt)
+	}
+	for _, subcmd := range cmd.subcommands {
+		out.Subcommands = append(out.Subcommands, commandToJSON(subcmd))
+	}
+	return &out
 }
 
 func (p *Parser) printOption(w io.Writer, spec *spec) {
-	ways := make([]string, 0, 2)
+	ways := make([]string, 0, 2+len(spec.aliases))
 	if spec.long != "" {
 		ways = append(ways, synopsis(spec, "--"+spec.long))
 	}
+	for _, alias := range spec.aliases {
+		ways = append(ways, synopsis(spec, "--"+alias))
+	}
 	if spec.short != "" {
 		ways = append(ways, synopsis(spec, "-"+spec.short))
 	}
 	if len(ways) > 0 {
-		printTwoCols(w, strings.Join(ways, ", "), spec.help, spec.defaultVal, spec.env)
+		help := spec.help
+		if spec.required {
+			help = strings.TrimSpace(help + " (required)")
+		}
+		p.printTwoCols(w, strings.Join(ways, ", "), help, spec.displayDefault(), p.envVar(spec))
 	}
 }
 
@@ -317,6 +598,15 @@ func (p *Parser) lookupCommand(path ...string) (*command, error) {
 	return cmd, nil
 }
 
+// usageSynopsis is like synopsis except that options taking several values
+// at once say so by repeating the placeholder
+func usageSynopsis(spec *spec, form string) string {
+	if spec.cardinality == multiple && !spec.separate {
+		return fmt.Sprintf("%s %s [%s ...]", form, spec.placeholder, spec.placeholder)
+	}
+	return synopsis(spec, form)
+}
+
 func synopsis(spec *spec, form string) string {
 	if spec.cardinality == zero {
 		return form
@@ -2,6 +2,7 @@ package arg
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -33,10 +34,10 @@ func (n *NameDotName) MarshalText() (text []byte, err error) {
 }
 
 func TestWriteUsage(t *testing.T) {
-	expectedUsage := "Usage: example [--name NAME] [--value VALUE] [--verbose] [--dataset DATASET] [--optimize OPTIMIZE] [--ids IDS] [--values VALUES] [--workers WORKERS] [--testenv TESTENV] [--file FILE] INPUT [OUTPUT [OUTPUT ...]]"
+	expectedUsage := "Usage: example [--name NAME] [--value VALUE] [--verbose] [--dataset DATASET] [--optimize OPTIMIZE] [--ids IDS [IDS ...]] [--values VALUES [VALUES ...]] [--workers WORKERS] [--testenv TESTENV] [--file FILE] INPUT [OUTPUT [OUTPUT ...]]"
 
 	expectedHelp := `
-Usage: example [--name NAME] [--value VALUE] [--verbose] [--dataset DATASET] [--optimize OPTIMIZE] [--ids IDS] [--values VALUES] [--workers WORKERS] [--testenv TESTENV] [--file FILE] INPUT [OUTPUT [OUTPUT ...]]
+Usage: example [--name NAME] [--value VALUE] [--verbose] [--dataset DATASET] [--optimize OPTIMIZE] [--ids IDS [IDS ...]] [--values VALUES [VALUES ...]] [--workers WORKERS] [--testenv TESTENV] [--file FILE] INPUT [OUTPUT [OUTPUT ...]]
 
 Positional arguments:
   INPUT
@@ -285,6 +286,32 @@ Options:
 	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
 }
 
+func TestUsageWithDescriptionField(t *testing.T) {
+	expectedHelp := `
+built for linux/amd64
+Usage: example [--foo FOO]
+
+Options:
+  --foo FOO
+  --help, -h             display this help and exit
+`
+	var args struct {
+		Description string `arg:"-"`
+		Foo         string
+	}
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.NotContains(t, help.String(), "built for")
+
+	args.Description = "built for linux/amd64"
+	help.Reset()
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
 func TestRequiredMultiplePositionals(t *testing.T) {
 	expectedUsage := "Usage: example REQUIREDMULTIPLE [REQUIREDMULTIPLE ...]"
 
@@ -365,6 +392,484 @@ Global options:
 	assert.Equal(t, expectedUsage, strings.TrimSpace(usage2.String()))
 }
 
+func TestUsageHideGlobalOptions(t *testing.T) {
+	expectedHelp := `
+Usage: example child [--values VALUES [VALUES ...]]
+
+Options:
+  --values VALUES        Values
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		Verbose bool `arg:"-v" help:"verbosity level"`
+		Child   *struct {
+			Values []float64 `help:"Values"`
+		} `arg:"subcommand:child"`
+	}
+
+	os.Args[0] = "example"
+	p, err := NewParser(Config{HideGlobalOptions: true}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	err = p.WriteHelpForSubcommand(&help, "child")
+	require.NoError(t, err)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithPositionalHelp(t *testing.T) {
+	expectedHelp := `
+Usage: example [--verbose] SRC DST <command> [<args>]
+
+Positional arguments:
+  SRC                    file to read
+  DST                    file to write [default: out.txt, env: DST]
+
+Options:
+  --verbose              be chatty
+  --help, -h             display this help and exit
+
+Commands:
+  get                    fetch an item
+`
+
+	expectedSubHelp := `
+Usage: example get ITEM
+
+Positional arguments:
+  ITEM                   item to fetch
+
+Global options:
+  --verbose              be chatty
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		Src     string `arg:"positional,required" help:"file to read"`
+		Dst     string `arg:"positional,env" default:"out.txt" help:"file to write"`
+		Verbose bool   `help:"be chatty"`
+		Get     *struct {
+			Item string `arg:"positional,required" help:"item to fetch"`
+		} `arg:"subcommand" help:"fetch an item"`
+	}
+
+	os.Args[0] = "example"
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+
+	var subHelp bytes.Buffer
+	err = p.WriteHelpForSubcommand(&subHelp, "get")
+	require.NoError(t, err)
+	assert.Equal(t, expectedSubHelp[1:], subHelp.String())
+}
+
+func TestUsageRepeatedValues(t *testing.T) {
+	expectedUsage := "Usage: example [--ids IDS [IDS ...]] [--labels KEY=VALUE [KEY=VALUE ...]] [--tag TAG]"
+
+	expectedHelp := `
+Usage: example [--ids IDS [IDS ...]] [--labels KEY=VALUE [KEY=VALUE ...]] [--tag TAG]
+
+Options:
+  --ids IDS
+  --labels KEY=VALUE
+  --tag TAG
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		IDs    []int `arg:"--ids"`
+		Labels map[string]string
+		Tag    []string `arg:"separate"`
+	}
+
+	os.Args[0] = "example"
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithCommandTree(t *testing.T) {
+	expectedHelp := `
+Usage: example <command> [<args>]
+
+Options:
+  --help, -h             display this help and exit
+
+Commands:
+  remote                 manage remotes
+    add                  add a remote
+    remove               remove a remote
+  status                 show the working tree status
+`
+
+	var args struct {
+		Remote *struct {
+			Add    *struct{} `arg:"subcommand" help:"add a remote"`
+			Remove *struct{} `arg:"subcommand" help:"remove a remote"`
+		} `arg:"subcommand" help:"manage remotes"`
+		Status *struct{} `arg:"subcommand" help:"show the working tree status"`
+	}
+
+	os.Args[0] = "example"
+	p, err := NewParser(Config{ShowCommandTree: true}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+
+	p, err = NewParser(Config{}, &args)
+	require.NoError(t, err)
+
+	help.Reset()
+	p.WriteHelp(&help)
+	assert.NotContains(t, help.String(), "add a remote")
+}
+
+func TestUsageWithSectionOrder(t *testing.T) {
+	expectedHelp := `
+Usage: example [--verbose] <command> [<args>]
+
+Commands:
+  get                    fetch an item
+  list                   list all items
+
+Options:
+  --verbose
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		Verbose bool
+		Get     *struct{} `arg:"subcommand" help:"fetch an item"`
+		List    *struct{} `arg:"subcommand" help:"list all items"`
+	}
+
+	p, err := NewParser(Config{Program: "example", SectionOrder: []string{"nonsense", SectionCommands}}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithPassthrough(t *testing.T) {
+	expectedUsage := "Usage: example [--verbose] INPUT [-- ARGS...]"
+
+	expectedHelp := `
+Usage: example [--verbose] INPUT [-- ARGS...]
+
+Positional arguments:
+  INPUT
+  ARGS                   arguments for the child process
+
+Options:
+  --verbose
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		Verbose bool
+		Input   string   `arg:"positional"`
+		Args    []string `arg:"passthrough" help:"arguments for the child process"`
+	}
+
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestWriteUsageJSON(t *testing.T) {
+	var args struct {
+		Verbose bool `arg:"-v" help:"verbosity level"`
+		Workers int  `arg:"env" default:"4"`
+		Fetch   *struct {
+			URL  string `arg:"required"`
+			Dest string `arg:"positional" help:"where to save"`
+		} `arg:"subcommand" help:"fetch a url"`
+	}
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, p.WriteUsageJSON(&buf))
+
+	var out struct {
+		Name    string
+		Options []struct {
+			Long, Short, Help, Default, Env, Placeholder string
+			Required                                     bool
+		}
+		Subcommands []struct {
+			Name    string
+			Help    string
+			Options []struct {
+				Long     string
+				Required bool
+			}
+			Positionals []struct{ Placeholder, Help string }
+		}
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+
+	assert.Equal(t, "example", out.Name)
+	require.Len(t, out.Options, 2)
+	assert.Equal(t, "--verbose", out.Options[0].Long)
+	assert.Equal(t, "-v", out.Options[0].Short)
+	assert.Equal(t, "verbosity level", out.Options[0].Help)
+	assert.Equal(t, "4", out.Options[1].Default)
+	assert.Equal(t, "WORKERS", out.Options[1].Env)
+
+	require.Len(t, out.Subcommands, 1)
+	assert.Equal(t, "fetch", out.Subcommands[0].Name)
+	assert.Equal(t, "fetch a url", out.Subcommands[0].Help)
+	require.Len(t, out.Subcommands[0].Options, 1)
+	assert.Equal(t, "--url", out.Subcommands[0].Options[0].Long)
+	assert.True(t, out.Subcommands[0].Options[0].Required)
+	require.Len(t, out.Subcommands[0].Positionals, 1)
+	assert.Equal(t, "DEST", out.Subcommands[0].Positionals[0].Placeholder)
+	assert.Equal(t, "where to save", out.Subcommands[0].Positionals[0].Help)
+}
+
+func TestUsageWithHeadings(t *testing.T) {
+	expectedHelp := `
+Usage: example sub [--force] INPUT
+
+Argumente:
+  INPUT
+
+Optionen:
+  --force
+
+Globale Optionen:
+  --verbose
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		Verbose bool
+		Sub     *struct {
+			Force bool
+			Input string `arg:"positional"`
+		} `arg:"subcommand"`
+	}
+
+	p, err := NewParser(Config{
+		Program:            "example",
+		PositionalsHeading: "Argumente:",
+		OptionsHeading:     "Optionen:",
+		GlobalsHeading:     "Globale Optionen:",
+		CommandsHeading:    "Befehle:",
+	}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	err = p.WriteHelpForSubcommand(&help, "sub")
+	require.NoError(t, err)
+	assert.Equal(t, expectedHelp[1:], help.String())
+
+	help.Reset()
+	p.WriteHelp(&help)
+	assert.Contains(t, help.String(), "\nBefehle:\n  sub\n")
+}
+
+func TestUsageWithEnvSection(t *testing.T) {
+	expectedHelp := `
+Usage: example [--host HOST]
+
+Options:
+  --host HOST [env: HOST]
+  --help, -h             display this help and exit
+
+Environment variables:
+  HOST
+  API_TOKEN              token for the API
+  TIMEOUT                request timeout [default: 30s]
+`
+
+	var args struct {
+		Host    string `arg:"env"`
+		Token   string `arg:"-" env:"API_TOKEN" help:"token for the API"`
+		Timeout string `arg:"--,env" default:"30s" help:"request timeout"`
+	}
+
+	p, err := NewParser(Config{Program: "example", ShowEnvSection: true}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+
+	p, err = NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	help.Reset()
+	p.WriteHelp(&help)
+	assert.NotContains(t, help.String(), "Environment variables:")
+}
+
+func TestUsageWithEnvSectionLeavesSpecsAlone(t *testing.T) {
+	var args struct {
+		Host string `arg:"env"`
+		Run  *struct {
+			Jobs int `arg:"env"`
+		} `arg:"subcommand"`
+	}
+	p, err := NewParser(Config{Program: "example", ShowEnvSection: true}, &args)
+	require.NoError(t, err)
+
+	// give the subcommand's options spare capacity that a careless append
+	// would write the global options into
+	run := p.cmd.subcommands[0]
+	run.specs = append(make([]*spec, 0, len(run.specs)+4), run.specs...)
+
+	var help bytes.Buffer
+	require.NoError(t, p.WriteHelpForSubcommand(&help, "run"))
+	assert.Contains(t, help.String(), "\n  JOBS\n  HOST\n")
+	for _, spec := range run.specs[len(run.specs):cap(run.specs)] {
+		assert.Nil(t, spec)
+	}
+}
+
+func TestUsageLongOptionWraps(t *testing.T) {
+	expectedHelp := `
+Usage: example [--optimizationlevel OPTIMIZATIONLEVEL] [--fast]
+
+Options:
+  --optimizationlevel OPTIMIZATIONLEVEL, -O OPTIMIZATIONLEVEL
+                         optimization level
+  --fast                 go fast
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		OptimizationLevel int  `arg:"-O" help:"optimization level"`
+		Fast              bool `help:"go fast"`
+	}
+
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithHelpColumn(t *testing.T) {
+	expectedHelp := `
+Usage: example [--name NAME] [--verbose]
+
+Options:
+  --name NAME
+          the name
+  --verbose
+          be verbose
+  --help, -h
+          display this help and exit
+`
+
+	var args struct {
+		Name    string `help:"the name"`
+		Verbose bool   `help:"be verbose"`
+	}
+
+	p, err := NewParser(Config{Program: "example", HelpColumn: 10}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithLongAliases(t *testing.T) {
+	expectedHelp := `
+Usage: example [--gray] [--dir DIR]
+
+Options:
+  --gray, --grey, --greyscale, -g
+                         disable colors
+  --dir DIR, --directory DIR, -C DIR
+                         working directory
+  --help, -h             display this help and exit
+`
+
+	var args struct {
+		Gray bool   `arg:"--gray,--grey,--greyscale,-g" help:"disable colors"`
+		Dir  string `arg:"-C,--dir,--directory" help:"working directory"`
+	}
+
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithHelpWidth(t *testing.T) {
+	expectedHelp := `
+Usage: example [--timeout TIMEOUT] [--name NAME]
+
+Options:
+  --timeout TIMEOUT      how long to wait for the
+                         server to respond before
+                         giving up [default: 30s,
+                         env: TIMEOUT]
+  --name NAME            short help
+  --help, -h             display this help and
+                         exit
+`
+
+	var args struct {
+		Timeout string `arg:"env" default:"30s" help:"how long to wait for the server to respond before giving up"`
+		Name    string `help:"short help"`
+	}
+
+	p, err := NewParser(Config{Program: "example", HelpWidth: 50}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithTuplePositional(t *testing.T) {
+	expectedUsage := "Usage: example [SRC DST [SRC DST ...]]"
+
+	var args struct {
+		Files []struct {
+			Src string
+			Dst string
+		} `arg:"positional"`
+	}
+
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
+}
+
 func TestNonexistentSubcommand(t *testing.T) {
 	var args struct {
 		sub *struct{} `arg:"subcommand"`
@@ -393,6 +898,35 @@ func TestNonexistentSubcommand(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUsageWithPositionalMinCount(t *testing.T) {
+	expectedUsage := "Usage: example SRC SRC [SRC ...]"
+
+	var args struct {
+		Src []string `arg:"positional,required" min:"2"`
+	}
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
+	assert.Equal(t, 3, strings.Count(usage.String(), "SRC"))
+}
+
+func TestUsageWithOptionalPositionalMinCount(t *testing.T) {
+	expectedUsage := "Usage: example FILE FILE FILE [FILE ...]"
+
+	var args struct {
+		File []string `arg:"positional" min:"3"`
+	}
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
+}
+
 func TestUsageWithoutLongNames(t *testing.T) {
 	expectedUsage := "Usage: example [-a PLACEHOLDER] -b SHORTONLY2"
 
@@ -401,7 +935,7 @@ Usage: example [-a PLACEHOLDER] -b SHORTONLY2
 
 Options:
   -a PLACEHOLDER         some help [default: some val]
-  -b SHORTONLY2          some help2
+  -b SHORTONLY2          some help2 (required)
   --help, -h             display this help and exit
 `
 	var args struct {
@@ -420,6 +954,60 @@ Options:
 	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
 }
 
+func TestUsageWithDocTag(t *testing.T) {
+	expectedHelp := `
+Usage: example [--name NAME] [--size SIZE] <command> [<args>]
+
+Options:
+  --name NAME            the name
+  --size SIZE            from the help tag
+  --help, -h             display this help and exit
+
+Commands:
+  run                    run the thing
+`
+	var args struct {
+		Name string    `doc:"the name"`
+		Size int       `help:"from the help tag" doc:"from the doc tag"`
+		Run  *struct{} `arg:"subcommand" doc:"run the thing"`
+	}
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+}
+
+func TestUsageWithRequiredOptions(t *testing.T) {
+	expectedUsage := "Usage: example --id ID [--name NAME] --token TOKEN"
+
+	expectedHelp := `
+Usage: example --id ID [--name NAME] --token TOKEN
+
+Options:
+  --id ID                the id (required)
+  --name NAME            the name
+  --token TOKEN          (required) [env: TOKEN]
+  --help, -h             display this help and exit
+`
+	var args struct {
+		ID    string `arg:"--id,required" help:"the id"`
+		Name  string `help:"the name"`
+		Token string `arg:"required,env"`
+	}
+	p, err := NewParser(Config{Program: "example"}, &args)
+	require.NoError(t, err)
+
+	var help bytes.Buffer
+	p.WriteHelp(&help)
+	assert.Equal(t, expectedHelp[1:], help.String())
+
+	var usage bytes.Buffer
+	p.WriteUsage(&usage)
+	assert.Equal(t, expectedUsage, strings.TrimSpace(usage.String()))
+}
+
 func TestUsageWithShortFirst(t *testing.T) {
 	expectedUsage := "Usage: example [-c CAT] [--dog DOG]"
 
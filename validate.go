@@ -0,0 +1,253 @@
+package arg
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// condition is a requirement that some other option has a particular value
+type condition struct {
+	ref   string // the field name or long name of the other option, as written in the tag
+	value string // the value that the other option must have for the condition to hold
+	spec  *spec  // the other option, resolved after all fields have been processed
+}
+
+// Validate checks that the options processed by the most recent call to Parse
+// satisfy their constraints, such as required options and mutually exclusive
+// groups. Parse does this automatically unless Config.DeferValidation is set,
+// but Validate can also be used to re-check the destination struct after the
+// program has modified it. Validate works from the current values in the
+// struct, so an option counts as present if its value is not the zero value,
+// or if the most recent call to Parse was given its zero value, as in
+// "--level 0", and it still has that value.
+func (p *Parser) Validate() error {
+	specs := p.lastSpecs
+	if specs == nil {
+		specs = p.cmd.specs
+	}
+	present := make(map[*spec]bool)
+	for _, spec := range specs {
+		v := p.val(spec.dest)
+		if !v.IsValid() {
+			continue
+		}
+		if !isZero(v) || p.givenZero[spec] {
+			present[spec] = true
+		}
+	}
+	return p.validate(specs, present)
+}
+
+// validate checks that the values of the given options are consistent with
+// their constraints. It runs after all values and defaults have been set.
+func (p *Parser) validate(specs []*spec, wasPresent map[*spec]bool) error {
+	// check mutually exclusive groups
+	var groups []string
+	members := make(map[string][]*spec)
+	for _, spec := range specs {
+		if spec.group == "" {
+			continue
+		}
+		if _, seen := members[spec.group]; !seen {
+			groups = append(groups, spec.group)
+		}
+		members[spec.group] = append(members[spec.group], spec)
+	}
+	for _, group := range groups {
+		var names, present []string
+		var required bool
+		for _, spec := range members[group] {
+			names = append(names, spec.name())
+			if wasPresent[spec] {
+				present = append(present, spec.name())
+			}
+			required = required || spec.groupReq
+		}
+		if len(present) > 1 {
+			return fmt.Errorf("%s cannot be used together", strings.Join(present, " and "))
+		}
+		if len(present) == 0 && required {
+			return fmt.Errorf("one of %s is required", strings.Join(names, ", "))
+		}
+	}
+
+	// check options before positionals so that the first error reported
+	// does not depend on the order in which fields were declared
+	var ordered []*spec
+	for _, spec := range specs {
+		if !spec.positional {
+			ordered = append(ordered, spec)
+		}
+	}
+	for _, spec := range specs {
+		if spec.positional {
+			ordered = append(ordered, spec)
+		}
+	}
+
+	for _, spec := range ordered {
+		if spec.required && !wasPresent[spec] {
+			msg := fmt.Sprintf("%s is required", spec.name())
+			if env := p.envVar(spec); env != "" {
+				msg += " (or environment variable " + env + ")"
+			}
+			return errors.New(msg)
+		}
+
+		if err := p.checkCount(spec); err != nil {
+			return err
+		}
+		if err := p.checkPattern(spec); err != nil {
+			return err
+		}
+		if err := p.checkPaths(spec); err != nil {
+			return err
+		}
+		if wasPresent[spec] {
+			continue
+		}
+
+		if cond := spec.requiredIf; cond != nil && p.holds(cond) {
+			return fmt.Errorf("%s is required when %s is %s", spec.name(), cond.spec.name(), cond.value)
+		}
+	}
+	return nil
+}
+
+// checkCount checks that a slice with a min or max tag holds an acceptable
+// number of values. An empty slice falls short of any min.
+func (p *Parser) checkCount(spec *spec) error {
+	if spec.min == 0 && spec.max == 0 {
+		return nil
+	}
+	var n int
+	v := p.val(spec.dest)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.IsValid() && v.Kind() == reflect.Slice {
+		n = v.Len()
+	}
+	if n < spec.min {
+		return fmt.Errorf("%s requires at least %d values but got %d", spec.name(), spec.min, n)
+	}
+	if spec.max != 0 && n > spec.max {
+		return fmt.Errorf("%s accepts at most %d values but got %d", spec.name(), spec.max, n)
+	}
+	return nil
+}
+
+// checkPattern checks that each non-empty value of an option with a pattern
+// tag matches the pattern
+func (p *Parser) checkPattern(spec *spec) error {
+	if spec.pattern == nil {
+		return nil
+	}
+	for _, s := range p.stringValues(spec) {
+		if s != "" && !spec.pattern.MatchString(s) {
+			return fmt.Errorf("%s must match %s", spec.name(), spec.pattern)
+		}
+	}
+	return nil
+}
+
+// stringValues returns the current value of an option holding a string, or
+// the elements of an option holding a slice of strings
+func (p *Parser) stringValues(spec *spec) []string {
+	var values []string
+	v := reflect.Indirect(p.val(spec.dest))
+	switch {
+	case !v.IsValid():
+	case v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if elem := reflect.Indirect(v.Index(i)); elem.IsValid() {
+				values = append(values, elem.String())
+			}
+		}
+	default:
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// checkPaths checks that the files named by an option with a path tag exist,
+// and are directories if the tag requires it
+func (p *Parser) checkPaths(spec *spec) error {
+	if !spec.pathExists && !spec.pathDir {
+		return nil
+	}
+	for _, path := range p.stringValues(spec) {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil {
+			if spec.pathDir {
+				return fmt.Errorf("directory does not exist: %s", path)
+			}
+			return fmt.Errorf("file does not exist: %s", path)
+		}
+		if spec.pathDir && !info.IsDir() {
+			return fmt.Errorf("not a directory: %s", path)
+		}
+	}
+	return nil
+}
+
+// holds returns true if the option referred to by the condition currently has
+// the value required by the condition
+func (p *Parser) holds(cond *condition) bool {
+	v := p.val(cond.spec.dest)
+	if !v.IsValid() {
+		return false
+	}
+	return formatValue(v) == cond.value
+}
+
+// formatValue returns the string form of a value for comparison with values
+// written in struct tags
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		if text, err := m.MarshalText(); err == nil {
+			return string(text)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// findSibling finds an option by its field name or long name
+func findSibling(specs []*spec, name string) *spec {
+	for _, spec := range specs {
+		if spec.field.Name == name || spec.hasLong(strings.TrimLeft(name, "-")) {
+			return spec
+		}
+	}
+	return nil
+}
+
+// choose checks that s is one of the allowed values for the option, if there
+// are any, and returns the allowed value as it was declared
+func (s *spec) choose(value string) (string, error) {
+	if len(s.choices) == 0 {
+		return value, nil
+	}
+	for _, choice := range s.choices {
+		if value == choice || (s.foldChoices && strings.EqualFold(value, choice)) {
+			return choice, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not one of %s", value, strings.Join(s.choices, ", "))
+}
@@ -0,0 +1,498 @@
+package arg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDeferred(t *testing.T) {
+	var args struct {
+		Name string `arg:"required"`
+		Mode string
+		Cert string `requiredif:"mode=ssl"`
+	}
+	p, err := NewParser(Config{DeferValidation: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--mode", "plain"})
+	require.NoError(t, err)
+
+	err = p.Validate()
+	assert.EqualError(t, err, "--name is required")
+
+	err = p.Parse([]string{"--name", "x", "--mode", "plain"})
+	require.NoError(t, err)
+	assert.NoError(t, p.Validate())
+
+	// changing the struct after parsing affects conditional requirements
+	args.Mode = "ssl"
+	assert.EqualError(t, p.Validate(), "--cert is required when --mode is ssl")
+
+	// and clearing a required option makes it missing again
+	args.Cert = "server.pem"
+	require.NoError(t, p.Validate())
+	args.Name = ""
+	assert.EqualError(t, p.Validate(), "--name is required")
+}
+
+func TestValidateZeroValue(t *testing.T) {
+	var args struct {
+		Count *int `arg:"required"`
+		Level int  `arg:"required"`
+	}
+	p, err := NewParser(Config{DeferValidation: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--count", "0", "--level", "0"})
+	require.NoError(t, err)
+
+	// a zero value given on the command line counts as present
+	assert.NoError(t, p.Validate())
+
+	// but a zero value that was not given counts as missing
+	err = p.Parse([]string{"--count", "0"})
+	require.NoError(t, err)
+	assert.EqualError(t, p.Validate(), "--level is required")
+	args.Level = 2
+	assert.NoError(t, p.Validate())
+}
+
+func TestValidateZeroValueInGroup(t *testing.T) {
+	var args struct {
+		Verbose bool `group:"output,required"`
+		Quiet   bool `group:"output"`
+	}
+	p, err := NewParser(Config{DeferValidation: true}, &args)
+	require.NoError(t, err)
+
+	err = p.Parse([]string{"--verbose=false"})
+	require.NoError(t, err)
+	assert.NoError(t, p.Validate())
+
+	err = p.Parse([]string{"--verbose=false", "--quiet=false"})
+	require.NoError(t, err)
+	assert.EqualError(t, p.Validate(), "--verbose and --quiet cannot be used together")
+}
+
+func TestValidateBeforeParse(t *testing.T) {
+	var args struct {
+		Name string `arg:"required"`
+	}
+	p, err := NewParser(Config{}, &args)
+	require.NoError(t, err)
+	assert.EqualError(t, p.Validate(), "--name is required")
+}
+
+func TestRequiredIfConditionMetAndPresent(t *testing.T) {
+	var args struct {
+		Mode string
+		Cert string `requiredif:"mode=ssl"`
+	}
+	err := parse("--mode ssl --cert server.pem", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "server.pem", args.Cert)
+}
+
+func TestRequiredIfConditionMetAndAbsent(t *testing.T) {
+	var args struct {
+		Mode string
+		Cert string `requiredif:"mode=ssl"`
+	}
+	err := parse("--mode ssl", &args)
+	assert.EqualError(t, err, "--cert is required when --mode is ssl")
+}
+
+func TestRequiredIfConditionNotMet(t *testing.T) {
+	var args struct {
+		Mode string
+		Cert string `requiredif:"mode=ssl"`
+	}
+	err := parse("--mode plain", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "", args.Cert)
+}
+
+func TestRequiredIfConditionMetByDefault(t *testing.T) {
+	var args struct {
+		Mode string `default:"ssl"`
+		Cert string `requiredif:"Mode=ssl"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, "--cert is required when --mode is ssl")
+}
+
+func TestRequiredIfBool(t *testing.T) {
+	type argsType struct {
+		Upload bool
+		Bucket string `requiredif:"upload=true"`
+	}
+
+	var args argsType
+	err := parse("--upload", &args)
+	assert.EqualError(t, err, "--bucket is required when --upload is true")
+
+	args = argsType{}
+	err = parse("", &args)
+	assert.NoError(t, err)
+}
+
+func TestRequiredIfPositional(t *testing.T) {
+	type argsType struct {
+		Action string `arg:"positional"`
+		Force  bool   `requiredif:"Action=delete"`
+	}
+
+	var args argsType
+	err := parse("delete", &args)
+	assert.EqualError(t, err, "--force is required when ACTION is delete")
+
+	args = argsType{}
+	err = parse("delete --force", &args)
+	require.NoError(t, err)
+	assert.True(t, args.Force)
+
+	args = argsType{}
+	err = parse("list", &args)
+	require.NoError(t, err)
+}
+
+func TestRequiredIfOnPositional(t *testing.T) {
+	type argsType struct {
+		Mode string
+		Cert string `arg:"positional" requiredif:"mode=ssl"`
+	}
+
+	var args argsType
+	err := parse("--mode ssl", &args)
+	assert.EqualError(t, err, "CERT is required when --mode is ssl")
+
+	args = argsType{}
+	err = parse("--mode ssl cert.pem", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "cert.pem", args.Cert)
+}
+
+func TestRequiredIfUnknownField(t *testing.T) {
+	var args struct {
+		Cert string `requiredif:"mode=ssl"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, `args.Cert: requiredif refers to unknown field "mode"`)
+}
+
+func TestRequiredIfMalformed(t *testing.T) {
+	var args struct {
+		Cert string `requiredif:"mode"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".Cert: requiredif must have the form field=value")
+}
+
+func TestGroupAtMostOne(t *testing.T) {
+	type argsType struct {
+		JSON bool `group:"format"`
+		YAML bool `group:"format"`
+	}
+
+	var args argsType
+	err := parse("", &args)
+	require.NoError(t, err)
+
+	args = argsType{}
+	err = parse("--yaml", &args)
+	require.NoError(t, err)
+	assert.True(t, args.YAML)
+
+	args = argsType{}
+	err = parse("--json --yaml", &args)
+	assert.EqualError(t, err, "--json and --yaml cannot be used together")
+}
+
+func TestGroupExactlyOne(t *testing.T) {
+	type argsType struct {
+		A bool   `group:"mode,required"`
+		B string `group:"mode"`
+		C int    `group:"mode"`
+	}
+
+	var args argsType
+	err := parse("", &args)
+	assert.EqualError(t, err, "one of --a, --b, --c is required")
+
+	args = argsType{}
+	err = parse("--b x", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "x", args.B)
+
+	args = argsType{}
+	err = parse("--a --c 1", &args)
+	assert.EqualError(t, err, "--a and --c cannot be used together")
+}
+
+func TestGroupFromEnvironment(t *testing.T) {
+	var args struct {
+		A string `arg:"env:GROUP_TEST_A" group:"mode,required"`
+		B string `group:"mode"`
+	}
+	_, err := parseWithEnv("--b x", []string{"GROUP_TEST_A=y"}, &args)
+	assert.EqualError(t, err, "--a and --b cannot be used together")
+}
+
+func TestGroupUnknownModifier(t *testing.T) {
+	var args struct {
+		A bool `group:"mode,sometimes"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".A: unrecognized group modifier 'sometimes'")
+}
+
+func TestChoices(t *testing.T) {
+	var args struct {
+		Format string `choices:"json,yaml,text"`
+	}
+	err := parse("--format yaml", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "yaml", args.Format)
+
+	err = parse("--format xml", &args)
+	assert.EqualError(t, err, `error processing --format: "xml" is not one of json, yaml, text`)
+}
+
+func TestChoicesExactRejectsCase(t *testing.T) {
+	var args struct {
+		Format string `choices:"json,yaml"`
+	}
+	err := parse("--format JSON", &args)
+	assert.EqualError(t, err, `error processing --format: "JSON" is not one of json, yaml`)
+}
+
+func TestChoicesFoldStoresCanonical(t *testing.T) {
+	var args struct {
+		Format  string   `choices:"json,YAML" choicescase:"fold"`
+		Formats []string `arg:"positional" choices:"json,YAML" choicescase:"fold"`
+	}
+	err := parse("--format JSON yaml Json", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "json", args.Format)
+	assert.Equal(t, []string{"YAML", "json"}, args.Formats)
+}
+
+func TestChoicesDefaultAndEnvironment(t *testing.T) {
+	var args struct {
+		Level string `arg:"env:CHOICES_LEVEL" choices:"debug,info" default:"info"`
+	}
+	_, err := parseWithEnv("", []string{"CHOICES_LEVEL=trace"}, &args)
+	assert.EqualError(t, err, `error processing environment variable CHOICES_LEVEL: "trace" is not one of debug, info`)
+}
+
+func TestChoicesNotAllowedOnMap(t *testing.T) {
+	var args struct {
+		M map[string]string `choices:"a,b"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, ".M: choices are not supported for map fields")
+}
+
+func TestRequiredPositionalUsesPlaceholder(t *testing.T) {
+	var args struct {
+		Input  string `arg:"positional,required"`
+		Output string `arg:"positional,required" placeholder:"DEST"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, "INPUT is required")
+
+	err = parse("a", &args)
+	assert.EqualError(t, err, "DEST is required")
+}
+
+func TestRequiredOptionsReportedBeforePositionals(t *testing.T) {
+	var args struct {
+		Input   string `arg:"positional,required"`
+		Name    string `arg:"required"`
+		Verbose bool
+	}
+	err := parse("--verbose", &args)
+	assert.EqualError(t, err, "--name is required")
+
+	err = parse("--verbose --name x", &args)
+	assert.EqualError(t, err, "INPUT is required")
+}
+
+func TestPositionalMinCount(t *testing.T) {
+	var args struct {
+		Files []string `arg:"positional" min:"2"`
+	}
+	err := parse("a", &args)
+	assert.EqualError(t, err, "FILES requires at least 2 values but got 1")
+
+	args.Files = nil
+	err = parse("a b c", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, args.Files)
+
+	args.Files = nil
+	err = parse("", &args)
+	assert.EqualError(t, err, "FILES requires at least 2 values but got 0")
+}
+
+func TestOptionMinCount(t *testing.T) {
+	var args struct {
+		Tags []string `min:"1"`
+	}
+	err := parse("", &args)
+	assert.EqualError(t, err, "--tags requires at least 1 values but got 0")
+
+	err = parse("--tags a", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, args.Tags)
+}
+
+func TestPositionalMaxCount(t *testing.T) {
+	type argsType struct {
+		Sources []string `arg:"positional,required" min:"1" max:"2"`
+		Dest    string   `arg:"positional"`
+	}
+
+	var args argsType
+	err := parse("a b c", &args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, args.Sources)
+	assert.Equal(t, "c", args.Dest)
+
+	args = argsType{}
+	err = parse("a b c d", &args)
+	assert.EqualError(t, err, "too many positional arguments at 'd'")
+
+	args = argsType{}
+	err = parse("", &args)
+	assert.EqualError(t, err, "SOURCES is required")
+}
+
+func TestOptionMaxCount(t *testing.T) {
+	var args struct {
+		Tags []string `max:"2"`
+	}
+	err := parse("--tags a b c", &args)
+	assert.EqualError(t, err, "--tags accepts at most 2 values but got 3")
+}
+
+func TestMinMaxInvalid(t *testing.T) {
+	var args1 struct {
+		Name string `min:"1"`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, ".Name: min and max are only supported for slice fields")
+
+	var args2 struct {
+		Names []string `min:"x"`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, ".Names: min must be a positive integer")
+
+	var args3 struct {
+		Names []string `min:"3" max:"2"`
+	}
+	err = parse("", &args3)
+	assert.EqualError(t, err, ".Names: min cannot be greater than max")
+}
+
+func TestPathExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-arg")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	missing := filepath.Join(dir, "missing.yaml")
+
+	var args struct {
+		Config string   `path:"exists"`
+		Inputs []string `path:"exists"`
+	}
+	err = parse("--config "+file+" --inputs "+file+" "+dir, &args)
+	require.NoError(t, err)
+
+	args.Inputs = nil
+	err = parse("--config "+missing, &args)
+	assert.EqualError(t, err, "file does not exist: "+missing)
+
+	args.Config = ""
+	err = parse("--inputs "+file+" "+missing, &args)
+	assert.EqualError(t, err, "file does not exist: "+missing)
+}
+
+func TestPathDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-arg")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+
+	var args struct {
+		Output string `path:"dir"`
+	}
+	err = parse("--output "+dir, &args)
+	require.NoError(t, err)
+
+	err = parse("--output "+file, &args)
+	assert.EqualError(t, err, "not a directory: "+file)
+
+	err = parse("--output "+filepath.Join(dir, "missing"), &args)
+	assert.EqualError(t, err, "directory does not exist: "+filepath.Join(dir, "missing"))
+}
+
+func TestPathInvalid(t *testing.T) {
+	var args1 struct {
+		Config string `path:"readable"`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, ".Config: unrecognized path modifier 'readable'")
+
+	var args2 struct {
+		Count int `path:"exists"`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, ".Count: path is only supported for string fields")
+}
+
+func TestPattern(t *testing.T) {
+	type argsType struct {
+		Name string   `pattern:"^[a-z]+$"`
+		Tags []string `pattern:"^[a-z]+$"`
+	}
+
+	var args argsType
+	err := parse("--name abc --tags x y", &args)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", args.Name)
+
+	args = argsType{}
+	err = parse("--name Abc", &args)
+	assert.EqualError(t, err, "--name must match ^[a-z]+$")
+
+	args = argsType{}
+	err = parse("--tags x Y z", &args)
+	assert.EqualError(t, err, "--tags must match ^[a-z]+$")
+
+	args = argsType{}
+	err = parse("", &args)
+	require.NoError(t, err)
+}
+
+func TestPatternInvalid(t *testing.T) {
+	var args1 struct {
+		Name string `pattern:"[a-z"`
+	}
+	err := parse("", &args1)
+	assert.EqualError(t, err, ".Name: invalid pattern: error parsing regexp: missing closing ]: `[a-z`")
+
+	var args2 struct {
+		Count int `pattern:"^[0-9]+$"`
+	}
+	err = parse("", &args2)
+	assert.EqualError(t, err, ".Count: pattern is only supported for string fields")
+}